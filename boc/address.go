@@ -1,6 +1,22 @@
 package boc
 
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
 type Address struct {
-	Workchain int
+	Workchain int32
 	Address   []byte
 }
+
+// String returns the raw form "workchain:hex" with lowercase hex, zero-padded to
+// 64 characters, e.g. "-1:3333...3333".
+func (a Address) String() string {
+	h := hex.EncodeToString(a.Address)
+	if len(h) < 64 {
+		h = strings.Repeat("0", 64-len(h)) + h
+	}
+	return fmt.Sprintf("%v:%v", a.Workchain, h)
+}
@@ -0,0 +1,25 @@
+package boc
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAddressString(t *testing.T) {
+	elector := Address{Workchain: -1, Address: bytes.Repeat([]byte{0x33}, 32)}
+	if elector.String() != "-1:3333333333333333333333333333333333333333333333333333333333333333" {
+		t.Fatalf("invalid elector address %v", elector.String())
+	}
+
+	a := Address{Workchain: 0, Address: make([]byte, 32)}
+	a.Address[0] = 0x0a
+	a.Address[31] = 0xBF
+	if a.String() != "0:0a000000000000000000000000000000000000000000000000000000000000bf" {
+		t.Fatalf("invalid address %v", a.String())
+	}
+
+	short := Address{Workchain: 0, Address: []byte{0x01}}
+	if short.String() != "0:0000000000000000000000000000000000000000000000000000000000000001" {
+		t.Fatalf("invalid short address %v", short.String())
+	}
+}
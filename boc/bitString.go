@@ -1,12 +1,13 @@
 package boc
 
 import (
+	"bytes"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"math"
 	"math/big"
-	"strconv"
+	"math/bits"
 	"strings"
 )
 
@@ -16,6 +17,8 @@ type BitString struct {
 	cursor int
 }
 
+// NewBitString allocates the whole buffer for bitLen bits up front, so writes
+// never reallocate it. A cell's 1023-bit string always owns a 128-byte buffer.
 func NewBitString(bitLen int) BitString {
 	return BitString{
 		buf:    make([]byte, int(math.Ceil(float64(bitLen)/float64(8)))),
@@ -98,6 +101,20 @@ func (s *BitString) WriteBit(val bool) error {
 	return nil
 }
 
+// WriteBits appends the written bits of bits, i.e. the first bits.Cursor() of them.
+func (s *BitString) WriteBits(bits *BitString) error {
+	err := s.checkWriteLen(bits.Cursor())
+	if err != nil {
+		return err
+	}
+	return s.writeBitsFrom(bits, 0, bits.Cursor())
+}
+
+// WriteBool writes a TL-B Bool flag as a single bit.
+func (s *BitString) WriteBool(val bool) error {
+	return s.WriteBit(val)
+}
+
 func (s *BitString) WriteBitArray(val []bool) error {
 	for _, item := range val {
 		err := s.WriteBit(item)
@@ -109,7 +126,11 @@ func (s *BitString) WriteBitArray(val []bool) error {
 }
 
 func (s *BitString) WriteBigUint(val *big.Int, bitLen int) error {
-	if bitLen == 0 || val.BitLen() > bitLen {
+	err := s.checkWriteLen(bitLen)
+	if err != nil {
+		return err
+	}
+	if val.BitLen() > bitLen {
 		return errors.New("bit length is too small")
 	}
 
@@ -124,6 +145,16 @@ func (s *BitString) WriteBigUint(val *big.Int, bitLen int) error {
 }
 
 func (s *BitString) WriteBigInt(val *big.Int, bitLen int) error {
+	err := s.checkWriteLen(bitLen)
+	if err != nil {
+		return err
+	}
+	if bitLen == 0 {
+		if val.Sign() != 0 {
+			return errors.New("bit length is too small")
+		}
+		return nil
+	}
 	if bitLen == 1 {
 		if val.Int64() == -1 {
 			err := s.WriteBit(true)
@@ -167,6 +198,10 @@ func (s *BitString) WriteBigInt(val *big.Int, bitLen int) error {
 }
 
 func (s *BitString) WriteUint(val int, bitLen int) error {
+	err := s.checkWriteLen(bitLen)
+	if err != nil {
+		return err
+	}
 	for i := bitLen - 1; i >= 0; i-- {
 		err := s.WriteBit(((val >> i) & 1) > 0)
 		if err != nil {
@@ -176,7 +211,45 @@ func (s *BitString) WriteUint(val int, bitLen int) error {
 	return nil
 }
 
+// SetUint overwrites bitLen already written bits starting at offset. The cursor is not moved.
+func (s *BitString) SetUint(offset int, val uint64, bitLen int) error {
+	if bitLen < 0 {
+		return errors.New("negative bit length")
+	}
+	if bitLen > 64 {
+		return errors.New("bit length must be at most 64")
+	}
+	if bits.Len64(val) > bitLen {
+		return errors.New("bit length is too small")
+	}
+	if offset < 0 || offset+bitLen > s.cursor {
+		return errors.New("SetUint region is out of the written bits")
+	}
+	for i := 0; i < bitLen; i++ {
+		var err error
+		if (val>>(bitLen-1-i))&1 > 0 {
+			err = s.On(offset + i)
+		} else {
+			err = s.Off(offset + i)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *BitString) WriteInt(val int, bitLen int) error {
+	err := s.checkWriteLen(bitLen)
+	if err != nil {
+		return err
+	}
+	if bitLen == 0 {
+		if val != 0 {
+			return errors.New("bit length is too small")
+		}
+		return nil
+	}
 	if bitLen == 1 {
 		if val == -1 {
 			err := s.WriteBit(true)
@@ -214,6 +287,20 @@ func (s *BitString) WriteInt(val int, bitLen int) error {
 	return nil
 }
 
+// WriteBoundedUint writes TL-B #<= max in the minimal number of bits able to hold max.
+func (s *BitString) WriteBoundedUint(val uint64, max uint64) error {
+	if val > max {
+		return errors.New("bounded integer is out of range")
+	}
+	for i := bits.Len64(max) - 1; i >= 0; i-- {
+		err := s.WriteBit((val>>i)&1 > 0)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *BitString) WriteCoins(amount int) error {
 	if amount == 0 {
 		err := s.WriteUint(0, 4)
@@ -221,7 +308,7 @@ func (s *BitString) WriteCoins(amount int) error {
 			return err
 		}
 	} else {
-		l := int(math.Ceil(float64(len(strconv.FormatInt(int64(amount), 16)) / 2)))
+		l := (bits.Len(uint(amount)) + 7) / 8
 		err := s.WriteUint(l, 4)
 		if err != nil {
 			return err
@@ -234,6 +321,66 @@ func (s *BitString) WriteCoins(amount int) error {
 	return nil
 }
 
+// WriteBigCoins writes VarUInteger 16. The amount must fit in 15 bytes.
+func (s *BitString) WriteBigCoins(amount *big.Int) error {
+	if amount.Sign() < 0 {
+		return errors.New("coins amount must be non-negative")
+	}
+	l := (amount.BitLen() + 7) / 8
+	if l > 15 {
+		return errors.New("coins amount does not fit in 15 bytes")
+	}
+	err := s.WriteUint(l, 4)
+	if err != nil {
+		return err
+	}
+	if l == 0 {
+		return nil
+	}
+	return s.WriteBigUint(amount, l*8)
+}
+
+// WriteVarInt writes VarInteger n, where lenBits is the width of the byte length,
+// using the minimal number of bytes.
+func (s *BitString) WriteVarInt(val *big.Int, lenBits int) error {
+	if lenBits <= 0 || lenBits >= 32 {
+		return fmt.Errorf("invalid length width %v, must be from 1 to 31 bits", lenBits)
+	}
+	bitLen := val.BitLen() + 1
+	if val.Sign() < 0 {
+		bitLen = new(big.Int).Not(val).BitLen() + 1
+	}
+	l := 0
+	if val.Sign() != 0 {
+		l = (bitLen + 7) / 8
+	}
+	if l >= 1<<lenBits {
+		return fmt.Errorf("value does not fit in %v bytes", 1<<lenBits-1)
+	}
+	err := s.checkWriteLen(lenBits + l*8)
+	if err != nil {
+		return err
+	}
+	err = s.WriteUint(l, lenBits)
+	if err != nil {
+		return err
+	}
+	return s.WriteBigInt(val, l*8)
+}
+
+func (s *BitString) WriteCoinsUint64(amount uint64) error {
+	return s.WriteBigCoins(new(big.Int).SetUint64(amount))
+}
+
+// WriteCoinsString writes a decimal amount of nanotons.
+func (s *BitString) WriteCoinsString(amount string) error {
+	v, ok := new(big.Int).SetString(amount, 10)
+	if !ok {
+		return fmt.Errorf("invalid coins amount %q", amount)
+	}
+	return s.WriteBigCoins(v)
+}
+
 func (s *BitString) WriteByte(val byte) error {
 	err := s.WriteUint(int(val), 8)
 	if err != nil {
@@ -243,6 +390,9 @@ func (s *BitString) WriteByte(val byte) error {
 }
 
 func (s *BitString) WriteBytes(data []byte) error {
+	if len(data)*8 > s.Available() {
+		return errors.New("BitString overflow")
+	}
 	for _, item := range data {
 		err := s.WriteByte(item)
 		if err != nil {
@@ -252,13 +402,25 @@ func (s *BitString) WriteBytes(data []byte) error {
 	return nil
 }
 
+// WriteAddressNone writes addr_none.
+func (s *BitString) WriteAddressNone() error {
+	return s.WriteUint(0, 2)
+}
+
+// WriteAddress writes MsgAddress: addr_none for a nil address, addr_std otherwise.
 func (s *BitString) WriteAddress(address *Address) error {
 	if address == nil {
-		err := s.WriteUint(0, 2)
+		err := s.WriteAddressNone()
 		if err != nil {
 			return err
 		}
 	} else {
+		if len(address.Address) != 32 {
+			return errors.New("std address must be 32 bytes long")
+		}
+		if address.Workchain < math.MinInt8 || address.Workchain > math.MaxInt8 {
+			return errors.New("std address workchain must fit in int8")
+		}
 		err := s.WriteUint(2, 2)
 		if err != nil {
 			return err
@@ -267,7 +429,7 @@ func (s *BitString) WriteAddress(address *Address) error {
 		if err != nil {
 			return err
 		}
-		err = s.WriteInt(address.Workchain, 8)
+		err = s.WriteInt(int(address.Workchain), 8)
 		if err != nil {
 			return err
 		}
@@ -289,45 +451,58 @@ func (s *BitString) SetTopUppedArray(arr []byte, fulfilledBytes bool) error {
 		return nil
 	}
 
-	foundEndBit := false
+	padding, err := topUppedPadding(arr[len(arr)-1])
+	if err != nil {
+		return err
+	}
+	s.cursor -= padding
+	return s.Off(s.cursor)
+}
 
-	for i := 0; i < 7; i++ {
-		s.cursor -= 1
-		if s.Get(s.cursor) {
-			foundEndBit = true
-			err := s.Off(s.cursor)
-			if err != nil {
-				return err
-			}
-			break
-		}
+// topUppedPadding returns the number of completion bits in the last byte of a
+// partial top-upped array.
+func topUppedPadding(last byte) (int, error) {
+	// the completion bit is the lowest set bit of the last byte and at least one
+	// data bit must precede it, otherwise the byte is not partial
+	if last == 0 {
+		return 0, errors.New("incorrect topUppedArray: missing completion bit")
 	}
-	if !foundEndBit {
-		return errors.New("incorrect topUppedArray")
+	tz := bits.TrailingZeros8(last)
+	if tz == 7 {
+		return 0, errors.New("incorrect topUppedArray: no data bits before completion bit")
 	}
-	return nil
+	return tz + 1, nil
 }
 
+// GetTopUppedArray returns the written bits as bytes. If their number is not a
+// multiple of 8, the last byte is completed with a one bit followed by zeros.
+// Otherwise no completion byte is added, so 8, 16 or 1016 bits give 1, 2 or 127
+// bytes, and 1023 bits give 128 bytes with the completion bit as the lowest one.
+// Bits after the cursor are never exposed.
 func (s *BitString) GetTopUppedArray() ([]byte, error) {
-	ret := s.Copy()
+	res := make([]byte, (s.cursor+7)/8)
+	copy(res, s.buf)
+	if rem := s.cursor % 8; rem != 0 {
+		res[len(res)-1] &= 0xff << (8 - rem)
+		res[len(res)-1] |= 1 << (7 - rem)
+	}
+	return res, nil
+}
 
-	tu := int(math.Ceil(float64(ret.Cursor())/8))*8 - ret.Cursor()
-	if tu > 0 {
-		tu = tu - 1
-		err := ret.WriteBit(true)
-		if err != nil {
-			return nil, err
-		}
-		for tu > 0 {
-			tu = tu - 1
-			err := ret.WriteBit(false)
-			if err != nil {
-				return nil, err
-			}
-		}
+// Bits returns the written bits, i.e. the first Cursor() of them.
+func (s *BitString) Bits() []bool {
+	res := make([]bool, s.cursor)
+	for i := range res {
+		res[i] = s.Get(i)
 	}
-	ret.buf = ret.buf[0:int(math.Ceil(float64(ret.cursor/8)))]
-	return ret.buf, nil
+	return res
+}
+
+// BitStringFromBools creates a BitString of len(bits) bits with all of them written.
+func BitStringFromBools(bits []bool) BitString {
+	res := NewBitString(len(bits))
+	res.WriteBitArray(bits)
+	return res
 }
 
 func (s *BitString) Print() {
@@ -356,8 +531,108 @@ func (s *BitString) ToFiftHex() string {
 	}
 }
 
+// ToBinaryString returns the written bits as a string of zeros and ones.
+func (s BitString) ToBinaryString() string {
+	var sb strings.Builder
+	for i := 0; i < s.cursor; i++ {
+		if s.Get(i) {
+			sb.WriteByte('1')
+		} else {
+			sb.WriteByte('0')
+		}
+	}
+	return sb.String()
+}
+
+// Compare compares the written bits lexicographically and returns -1, 0 or 1.
+// A proper prefix is less than the longer string.
+func (s BitString) Compare(other BitString) int {
+	n := s.cursor
+	if other.cursor < n {
+		n = other.cursor
+	}
+
+	res := bytes.Compare(s.buf[:n/8], other.buf[:n/8])
+	if res != 0 {
+		return res
+	}
+	for i := n / 8 * 8; i < n; i++ {
+		a, b := s.Get(i), other.Get(i)
+		if a != b {
+			if b {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	switch {
+	case s.cursor < other.cursor:
+		return -1
+	case s.cursor > other.cursor:
+		return 1
+	}
+	return 0
+}
+
+// Equal reports whether both strings have the same written bits.
+func (s BitString) Equal(other BitString) bool {
+	return s.Compare(other) == 0
+}
+
+// And returns the bitwise AND of the written bits of s and other, which must have equal lengths.
+func (s BitString) And(other BitString) (BitString, error) {
+	return s.bitwise(other, func(a, b bool) bool { return a && b })
+}
+
+// Or returns the bitwise OR of the written bits of s and other, which must have equal lengths.
+func (s BitString) Or(other BitString) (BitString, error) {
+	return s.bitwise(other, func(a, b bool) bool { return a || b })
+}
+
+// Xor returns the bitwise XOR of the written bits of s and other, which must have equal lengths.
+func (s BitString) Xor(other BitString) (BitString, error) {
+	return s.bitwise(other, func(a, b bool) bool { return a != b })
+}
+
+func (s BitString) bitwise(other BitString, op func(a, b bool) bool) (BitString, error) {
+	if s.Cursor() != other.Cursor() {
+		return BitString{}, fmt.Errorf("bit length mismatch: %v and %v", s.Cursor(), other.Cursor())
+	}
+	res := NewBitString(s.Cursor())
+	for i := 0; i < s.Cursor(); i++ {
+		err := res.WriteBit(op(s.Get(i), other.Get(i)))
+		if err != nil {
+			return BitString{}, err
+		}
+	}
+	return res, nil
+}
+
+// writeBitsFrom appends n bits of src starting at offset.
+func (s *BitString) writeBitsFrom(src *BitString, offset int, n int) error {
+	for i := offset; i < offset+n; i++ {
+		err := s.WriteBit(src.Get(i))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkWriteLen fails if bitLen is negative or doesn't fit in the free space.
+func (s *BitString) checkWriteLen(bitLen int) error {
+	if bitLen < 0 {
+		return errors.New("negative bit length")
+	}
+	if bitLen > s.Available() {
+		return errors.New("BitString overflow")
+	}
+	return nil
+}
+
 func (s *BitString) checkRange(n int) error {
-	if n > s.Length() {
+	if n >= s.Length() {
 		return errors.New("BitString overflow")
 	}
 	return nil
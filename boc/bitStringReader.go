@@ -1,25 +1,38 @@
 package boc
 
 import (
+	"errors"
+	"fmt"
 	"math"
 	"math/big"
+	"math/bits"
 )
 
+var errNotEnoughBits = errors.New("not enough bits")
+
 type BitStringReader struct {
 	buf    []byte
 	len    int
 	cursor int
+	// refs of the parsed cell, set by Cell.BeginParse
+	refs []*Cell
+	// refCursor is the number of refs of the parsed cell already taken
+	refCursor int
 }
 
 func NewBitStringReader(bitString *BitString) BitStringReader {
 	var reader = BitStringReader{
 		buf:    bitString.Buffer(),
-		len:    0,
+		len:    bitString.Cursor(),
 		cursor: 0,
 	}
 	return reader
 }
 
+func (s *BitStringReader) Available() int {
+	return s.len - s.cursor
+}
+
 func (s *BitStringReader) getBit(n int) bool {
 	return (s.buf[(n/8)|0] & (1 << (7 - (n % 8)))) > 0
 }
@@ -30,15 +43,61 @@ func (s *BitStringReader) Skip(n int) {
 	}
 }
 
+// ReadBits reads TL-B bits n as a new BitString with its own buffer.
+func (s *BitStringReader) ReadBits(n int) (BitString, error) {
+	err := s.checkBitLen(n)
+	if err != nil {
+		return BitString{}, err
+	}
+	res := NewBitString(n)
+	for i := 0; i < n; i++ {
+		res.WriteBit(s.ReadBit())
+	}
+	return res, nil
+}
+
+// ReadRemaining returns the unread bits as a new BitString and moves the cursor to
+// the end. The result has its own buffer and is positioned after the copied bits.
+func (s *BitStringReader) ReadRemaining() BitString {
+	res := NewBitString(s.Available())
+	for s.Available() > 0 {
+		res.WriteBit(s.ReadBit())
+	}
+	return res
+}
+
 func (s *BitStringReader) ReadBit() bool {
 	var bit = s.getBit(s.cursor)
 	s.cursor++
 	return bit
 }
 
-func (s *BitStringReader) ReadBigUint(bitLen int) *big.Int {
+// ReadBool reads a TL-B Bool flag. Unlike ReadBit, it fails when no bits are left.
+func (s *BitStringReader) ReadBool() (bool, error) {
+	if s.Available() < 1 {
+		return false, errNotEnoughBits
+	}
+	return s.ReadBit(), nil
+}
+
+// checkBitLen fails if bitLen is negative or more than the remaining bits.
+func (s *BitStringReader) checkBitLen(bitLen int) error {
+	if bitLen < 0 {
+		return errors.New("negative bit length")
+	}
+	if bitLen > s.Available() {
+		return errNotEnoughBits
+	}
+	return nil
+}
+
+func (s *BitStringReader) ReadBigUint(bitLen int) (*big.Int, error) {
+	err := s.checkBitLen(bitLen)
+	if err != nil {
+		return nil, err
+	}
 	if bitLen == 0 {
-		return big.NewInt(0)
+		return big.NewInt(0), nil
 	}
 	var res = ""
 	for i := 0; i < bitLen; i++ {
@@ -50,34 +109,48 @@ func (s *BitStringReader) ReadBigUint(bitLen int) *big.Int {
 	}
 	var num = big.NewInt(0)
 	num.SetString(res, 2)
-	return num
+	return num, nil
 }
 
-func (s *BitStringReader) ReadBigInt(bitLen int) *big.Int {
+func (s *BitStringReader) ReadBigInt(bitLen int) (*big.Int, error) {
+	err := s.checkBitLen(bitLen)
+	if err != nil {
+		return nil, err
+	}
 	if bitLen == 0 {
-		return big.NewInt(0)
+		return big.NewInt(0), nil
 	}
 	if bitLen == 1 {
 		if s.ReadBit() {
-			return big.NewInt(-1)
+			return big.NewInt(-1), nil
 		} else {
-			return big.NewInt(0)
+			return big.NewInt(0), nil
 		}
 	}
 
 	if s.ReadBit() {
-		var base = s.ReadBigUint(bitLen - 1)
+		base, err := s.ReadBigUint(bitLen - 1)
+		if err != nil {
+			return nil, err
+		}
 		var b = big.NewInt(2)
 		var nb = b.Exp(b, big.NewInt(int64(bitLen-1)), nil)
-		return base.Sub(base, nb)
+		return base.Sub(base, nb), nil
 	} else {
 		return s.ReadBigUint(bitLen - 1)
 	}
 }
 
-func (s *BitStringReader) ReadUint(bitLen int) uint {
+func (s *BitStringReader) ReadUint(bitLen int) (uint, error) {
+	err := s.checkBitLen(bitLen)
+	if err != nil {
+		return 0, err
+	}
+	if bitLen > 64 {
+		return 0, errors.New("bit length is too big")
+	}
 	if bitLen == 0 {
-		return 0
+		return 0, nil
 	}
 
 	var res uint = 0
@@ -88,47 +161,329 @@ func (s *BitStringReader) ReadUint(bitLen int) uint {
 		}
 	}
 
-	return res
+	return res, nil
 }
 
-func (s *BitStringReader) ReadInt(bitLen int) int {
+func (s *BitStringReader) ReadInt(bitLen int) (int, error) {
+	err := s.checkBitLen(bitLen)
+	if err != nil {
+		return 0, err
+	}
+	if bitLen > 64 {
+		return 0, errors.New("bit length is too big")
+	}
 	if bitLen == 0 {
-		return 0
+		return 0, nil
 	}
 	if bitLen == 1 {
 		if s.ReadBit() {
-			return -1
+			return -1, nil
 		} else {
-			return 0
+			return 0, nil
 		}
 	}
 
 	if s.ReadBit() {
-		base := s.ReadUint(bitLen - 1)
-		return int(base - uint(math.Pow(2, float64(bitLen-1))))
+		base, err := s.ReadUint(bitLen - 1)
+		if err != nil {
+			return 0, err
+		}
+		return int(base - uint(math.Pow(2, float64(bitLen-1)))), nil
 	} else {
-		return int(s.ReadUint(bitLen - 1))
+		v, err := s.ReadUint(bitLen - 1)
+		return int(v), err
+	}
+}
+
+// ReadOpcode reads a 32-bit message op tag.
+func (s *BitStringReader) ReadOpcode() (uint32, error) {
+	op, err := s.ReadUint(32)
+	return uint32(op), err
+}
+
+// ExpectOpcode reads a 32-bit op tag and fails if it isn't want.
+func ExpectOpcode(r *BitStringReader, want uint32) error {
+	op, err := r.ReadOpcode()
+	if err != nil {
+		return err
+	}
+	if op != want {
+		return fmt.Errorf("unexpected opcode 0x%08x, expected 0x%08x", op, want)
+	}
+	return nil
+}
+
+// ReadTag reads a constructor tag of bitLen bits, to be converted to a typed enum
+// by the caller, e.g. AccountStatus(tag).
+func (s *BitStringReader) ReadTag(bitLen int) (uint, error) {
+	if bitLen > 32 {
+		return 0, fmt.Errorf("tag of %v bits is too long", bitLen)
+	}
+	return s.ReadUint(bitLen)
+}
+
+// ReadBoundedUint reads TL-B #<= max, stored in the minimal number of bits able to hold max.
+func (s *BitStringReader) ReadBoundedUint(max uint64) (uint64, error) {
+	v, err := s.ReadUint(bits.Len64(max))
+	if err != nil {
+		return 0, err
+	}
+	val := uint64(v)
+	if val > max {
+		return 0, errors.New("bounded integer is out of range")
+	}
+	return val, nil
+}
+
+// ReadBigCoins reads VarUInteger 16 of any size.
+func (s *BitStringReader) ReadBigCoins() (*big.Int, error) {
+	return s.readVarUint(4)
+}
+
+// readVarUint reads VarUInteger n, where lenBits is the width of the byte length.
+func (s *BitStringReader) readVarUint(lenBits int) (*big.Int, error) {
+	l, err := s.ReadUint(lenBits)
+	if err != nil {
+		return nil, err
+	}
+	return s.ReadBigUint(int(l) * 8)
+}
+
+// ReadVarInt reads VarInteger n, where lenBits is the width of the byte length.
+func (s *BitStringReader) ReadVarInt(lenBits int) (*big.Int, error) {
+	l, err := s.ReadUint(lenBits)
+	if err != nil {
+		return nil, err
+	}
+	return s.ReadBigInt(int(l) * 8)
+}
+
+// ReadCurrencyCollection reads grams and the extra currencies dict
+// (HashmapE 32 (VarUInteger 32)). Extra currencies are keyed by the decimal
+// currency id; the map is empty when the dict is. The reader must come from
+// Cell.BeginParse, since the dict is stored in a ref.
+func (s *BitStringReader) ReadCurrencyCollection() (grams *big.Int, extra map[string]*big.Int, err error) {
+	grams, err = s.ReadBigCoins()
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.Available() < 1 {
+		return nil, nil, errNotEnoughBits
+	}
+	extra = make(map[string]*big.Int)
+	if !s.ReadBit() {
+		return grams, extra, nil
+	}
+	root, err := s.readRef()
+	if err != nil {
+		return nil, nil, err
+	}
+	items, err := ParseDict(root, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, item := range items {
+		r := item.Value.BeginParse()
+		amount, err := r.readVarUint(5)
+		if err != nil {
+			return nil, nil, err
+		}
+		extra[item.BigKey().String()] = amount
 	}
+	return grams, extra, nil
 }
 
-func (s *BitStringReader) ReadCoins() uint {
-	bytes := s.ReadUint(4)
+// RefsCount returns the number of refs of the parsed cell. Readers created by
+// NewBitStringReader have no refs.
+func (s *BitStringReader) RefsCount() int {
+	return len(s.refs)
+}
+
+// LoadRef returns a reader positioned at the start of the i-th ref of the parsed
+// cell. It does not depend on refs already taken by other reads.
+func (s *BitStringReader) LoadRef(i int) (BitStringReader, error) {
+	if i < 0 || i >= len(s.refs) {
+		return BitStringReader{}, fmt.Errorf("ref %v is missing, cell has %v refs", i, len(s.refs))
+	}
+	return s.refs[i].BeginParse(), nil
+}
+
+// readRef takes the next ref of the parsed cell.
+func (s *BitStringReader) readRef() (*Cell, error) {
+	if s.refCursor >= len(s.refs) {
+		return nil, errors.New("not enough refs")
+	}
+	ref := s.refs[s.refCursor]
+	s.refCursor++
+	return ref, nil
+}
+
+// ReadUintLeq reads TL-B #<= n. Same as ReadBoundedUint.
+func (s *BitStringReader) ReadUintLeq(n uint64) (uint64, error) {
+	return s.ReadBoundedUint(n)
+}
+
+// ReadUintLess reads TL-B #< n, stored in the minimal number of bits able to hold n-1.
+func (s *BitStringReader) ReadUintLess(n uint64) (uint64, error) {
+	if n == 0 {
+		return 0, errors.New("no value is less than zero")
+	}
+	return s.ReadBoundedUint(n - 1)
+}
+
+// ReadCoins reads VarUInteger 16 into a uint. Amounts longer than 8 bytes are an
+// error, use ReadBigCoins to read any valid amount.
+func (s *BitStringReader) ReadCoins() (uint, error) {
+	bytes, err := s.ReadUint(4)
+	if err != nil {
+		return 0, err
+	}
+	if bytes > 8 {
+		return 0, fmt.Errorf("coins amount of %v bytes does not fit in uint", bytes)
+	}
 	if bytes == 0 {
-		return 0
+		return 0, nil
 	}
 	return s.ReadUint(int(bytes * 8))
 }
 
-func (s *BitStringReader) ReadByte() byte {
-	return byte(s.ReadUint(8))
+func (s *BitStringReader) ReadByte() (byte, error) {
+	v, err := s.ReadUint(8)
+	return byte(v), err
 }
 
-func (s *BitStringReader) ReadBytes(size int) []byte {
+func (s *BitStringReader) ReadBytes(size int) ([]byte, error) {
+	if size < 0 {
+		return nil, errors.New("negative byte count")
+	}
+	err := s.checkBitLen(size * 8)
+	if err != nil {
+		return nil, err
+	}
 	res := make([]byte, size)
 
 	for i := 0; i < size; i++ {
-		res[i] = byte(s.ReadUint(8))
+		res[i], _ = s.ReadByte()
 	}
 
-	return res
+	return res, nil
+}
+
+// ReadHash256 reads 256 bits into a fixed array without allocating.
+func (s *BitStringReader) ReadHash256() ([32]byte, error) {
+	var res [32]byte
+	err := s.checkBitLen(256)
+	if err != nil {
+		return res, err
+	}
+	for i := range res {
+		res[i], _ = s.ReadByte()
+	}
+	return res, nil
+}
+
+// ReadUintLE reads a little-endian unsigned integer of byteLen bytes. The reader
+// must be at a byte boundary.
+func (s *BitStringReader) ReadUintLE(byteLen int) (uint64, error) {
+	if byteLen < 0 || byteLen > 8 {
+		return 0, errors.New("byte length must be between 0 and 8")
+	}
+	if s.cursor%8 != 0 {
+		return 0, errors.New("reader is not byte aligned")
+	}
+	err := s.checkBitLen(byteLen * 8)
+	if err != nil {
+		return 0, err
+	}
+	var res uint64
+	for i := 0; i < byteLen; i++ {
+		b, _ := s.ReadByte()
+		res |= uint64(b) << (8 * i)
+	}
+	return res, nil
+}
+
+// ReadStdAddress reads addr_std into a fixed-size array. Anycast addresses are rejected.
+func (s *BitStringReader) ReadStdAddress() (int32, [32]byte, error) {
+	return s.ReadStdAddressCustom(false)
+}
+
+// ReadStdAddressCustom reads addr_std. If allowAnycast is set, anycast addresses are
+// accepted and the rewrite prefix is applied to the returned address.
+func (s *BitStringReader) ReadStdAddressCustom(allowAnycast bool) (int32, [32]byte, error) {
+	tag, err := s.ReadUint(2)
+	if err != nil {
+		return 0, [32]byte{}, err
+	}
+	if tag != 2 {
+		return 0, [32]byte{}, errors.New("not an addr_std address")
+	}
+	return s.readStdAddressBody(allowAnycast)
+}
+
+// ReadAddress reads MsgAddress. Returns nil for addr_none, anycast addresses are
+// rewritten. External and variable length addresses are not supported.
+func (s *BitStringReader) ReadAddress() (*Address, error) {
+	tag, err := s.ReadUint(2)
+	if err != nil {
+		return nil, err
+	}
+	switch tag {
+	case 0:
+		return nil, nil
+	case 2:
+		workchain, addr, err := s.readStdAddressBody(true)
+		if err != nil {
+			return nil, err
+		}
+		return &Address{Workchain: workchain, Address: addr[:]}, nil
+	default:
+		return nil, errors.New("unsupported address type")
+	}
+}
+
+func (s *BitStringReader) readStdAddressBody(allowAnycast bool) (int32, [32]byte, error) {
+	var addr [32]byte
+
+	if s.Available() < 1 {
+		return 0, addr, errNotEnoughBits
+	}
+
+	depth := 0
+	var prefix uint
+	if s.ReadBit() {
+		if !allowAnycast {
+			return 0, addr, errors.New("anycast addresses are not allowed")
+		}
+		d, err := s.ReadUint(5)
+		if err != nil {
+			return 0, addr, err
+		}
+		depth = int(d)
+		if depth < 1 || depth > 30 {
+			return 0, addr, errors.New("invalid anycast depth")
+		}
+		prefix, err = s.ReadUint(depth)
+		if err != nil {
+			return 0, addr, err
+		}
+	}
+
+	if s.Available() < 8+256 {
+		return 0, addr, errNotEnoughBits
+	}
+	wc, _ := s.ReadInt(8)
+	workchain := int32(wc)
+	addr, _ = s.ReadHash256()
+
+	for i := 0; i < depth; i++ {
+		mask := byte(1 << (7 - i%8))
+		if (prefix>>(depth-1-i))&1 > 0 {
+			addr[i/8] |= mask
+		} else {
+			addr[i/8] &^= mask
+		}
+	}
+
+	return workchain, addr, nil
 }
@@ -0,0 +1,613 @@
+package boc
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+)
+
+func TestReadStdAddress(t *testing.T) {
+	raw := bytes.Repeat([]byte{0xab}, 32)
+
+	s := NewBitString(1023)
+	s.WriteAddress(&Address{Workchain: -1, Address: raw})
+	s.WriteAddress(nil)
+
+	r := NewBitStringReader(&s)
+	workchain, addr, err := r.ReadStdAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if workchain != -1 || !bytes.Equal(addr[:], raw) {
+		t.Fatalf("invalid address %v:%x", workchain, addr)
+	}
+
+	_, _, err = r.ReadStdAddress()
+	if err == nil {
+		t.Fatal("addr_none must not be read as addr_std")
+	}
+}
+
+func TestReadStdAddressAnycast(t *testing.T) {
+	s := NewBitString(1023)
+	s.WriteUint(2, 2)
+	s.WriteBit(true)
+	s.WriteUint(3, 5)
+	s.WriteUint(0b101, 3)
+	s.WriteInt(0, 8)
+	s.WriteBytes(make([]byte, 32))
+
+	r := NewBitStringReader(&s)
+	_, _, err := r.ReadStdAddress()
+	if err == nil {
+		t.Fatal("anycast address must be rejected by default")
+	}
+
+	r = NewBitStringReader(&s)
+	workchain, addr, err := r.ReadStdAddressCustom(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if workchain != 0 || addr[0] != 0b10100000 {
+		t.Fatalf("rewrite prefix is not applied: %x", addr)
+	}
+}
+
+func TestReadStdAddressNotEnoughBits(t *testing.T) {
+	s := NewBitString(1023)
+	s.WriteUint(2, 2)
+	s.WriteUint(0, 1)
+	s.WriteInt(0, 8)
+	s.WriteBytes(make([]byte, 16))
+
+	r := NewBitStringReader(&s)
+	_, _, err := r.ReadStdAddress()
+	if err == nil {
+		t.Fatal("expected error for truncated address")
+	}
+}
+
+func TestBoundedUint(t *testing.T) {
+	s := NewBitString(1023)
+	err := s.WriteBoundedUint(3, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Cursor() != 2 {
+		t.Fatalf("#<= 3 must take 2 bits, got %v", s.Cursor())
+	}
+	err = s.WriteBoundedUint(200, 255)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Cursor() != 10 {
+		t.Fatalf("#<= 255 must take 8 bits, got %v", s.Cursor()-2)
+	}
+	if s.WriteBoundedUint(4, 3) == nil {
+		t.Fatal("expected out of range error")
+	}
+
+	r := NewBitStringReader(&s)
+	v, err := r.ReadBoundedUint(3)
+	if err != nil || v != 3 {
+		t.Fatalf("invalid value %v: %v", v, err)
+	}
+	v, err = r.ReadBoundedUint(255)
+	if err != nil || v != 200 {
+		t.Fatalf("invalid value %v: %v", v, err)
+	}
+}
+
+func TestReadBoundedUintOutOfRange(t *testing.T) {
+	s := NewBitString(1023)
+	s.WriteUint(6, 3)
+	r := NewBitStringReader(&s)
+	_, err := r.ReadBoundedUint(5)
+	if err == nil {
+		t.Fatal("expected out of range error")
+	}
+}
+
+func TestExpectOpcode(t *testing.T) {
+	s := NewBitString(1023)
+	s.WriteUint(0x0f8a7ea5, 32)
+	s.WriteUint(0x5fcc3d14, 32)
+
+	r := NewBitStringReader(&s)
+	err := ExpectOpcode(&r, 0x0f8a7ea5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ExpectOpcode(&r, 0x0f8a7ea5)
+	if err == nil {
+		t.Fatal("expected opcode mismatch")
+	}
+	if err.Error() != "unexpected opcode 0x5fcc3d14, expected 0x0f8a7ea5" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = r.ReadOpcode()
+	if err == nil {
+		t.Fatal("expected not enough bits error")
+	}
+}
+
+func TestReadUintLeqLessWidth(t *testing.T) {
+	cases := []struct {
+		n    uint64
+		leq  int
+		less int
+	}{
+		{1, 1, 0},
+		{2, 2, 1},
+		{3, 2, 2},
+		{4, 3, 2},
+		{5, 3, 3},
+		{255, 8, 8},
+		{256, 9, 8},
+		{1 << 32, 33, 32},
+	}
+
+	for _, c := range cases {
+		s := NewBitString(1023)
+		s.WriteUint(0, 128)
+
+		r := NewBitStringReader(&s)
+		_, err := r.ReadUintLeq(c.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.cursor != c.leq {
+			t.Fatalf("#<= %v: expected %v bits, got %v", c.n, c.leq, r.cursor)
+		}
+
+		r = NewBitStringReader(&s)
+		_, err = r.ReadUintLess(c.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.cursor != c.less {
+			t.Fatalf("#< %v: expected %v bits, got %v", c.n, c.less, r.cursor)
+		}
+	}
+}
+
+func TestReadUintLessOutOfRange(t *testing.T) {
+	s := NewBitString(1023)
+	s.WriteUint(5, 3)
+	r := NewBitStringReader(&s)
+	_, err := r.ReadUintLess(5)
+	if err == nil {
+		t.Fatal("expected out of range error")
+	}
+
+	r = NewBitStringReader(&s)
+	_, err = r.ReadUintLess(0)
+	if err == nil {
+		t.Fatal("expected error for #< 0")
+	}
+}
+
+func TestReadUintLE(t *testing.T) {
+	s := NewBitString(1023)
+	s.WriteBytes([]byte{0x78, 0x56, 0x34, 0x12, 0xff})
+	r := NewBitStringReader(&s)
+	v, err := r.ReadUintLE(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 0x12345678 {
+		t.Fatalf("invalid value %x", v)
+	}
+
+	r.ReadBit()
+	_, err = r.ReadUintLE(1)
+	if err == nil {
+		t.Fatal("unaligned read must be rejected")
+	}
+
+	r = NewBitStringReader(&s)
+	_, err = r.ReadUintLE(6)
+	if err == nil {
+		t.Fatal("expected not enough bits")
+	}
+}
+
+func mustReadUint(t *testing.T, r *BitStringReader, bitLen int) uint {
+	t.Helper()
+	v, err := r.ReadUint(bitLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestReadInvalidBitLength(t *testing.T) {
+	s := NewBitString(64)
+	s.WriteUint(0, 64)
+	for _, bitLen := range []int{-1, 1 << 30} {
+		r := NewBitStringReader(&s)
+		if _, err := r.ReadUint(bitLen); err == nil {
+			t.Fatalf("ReadUint(%v) must fail", bitLen)
+		}
+		if _, err := r.ReadInt(bitLen); err == nil {
+			t.Fatalf("ReadInt(%v) must fail", bitLen)
+		}
+		if _, err := r.ReadBigUint(bitLen); err == nil {
+			t.Fatalf("ReadBigUint(%v) must fail", bitLen)
+		}
+		if _, err := r.ReadBigInt(bitLen); err == nil {
+			t.Fatalf("ReadBigInt(%v) must fail", bitLen)
+		}
+		if _, err := r.ReadBytes(bitLen); err == nil {
+			t.Fatalf("ReadBytes(%v) must fail", bitLen)
+		}
+		if r.Available() != 64 {
+			t.Fatal("failed reads must not move the cursor")
+		}
+	}
+}
+
+func TestReadHash256(t *testing.T) {
+	s := NewBitString(1023)
+	s.WriteBit(true)
+	for i := 0; i < 32; i++ {
+		s.WriteUint(i, 8)
+	}
+	r := NewBitStringReader(&s)
+	r.ReadBit()
+	h, err := r.ReadHash256()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range h {
+		if h[i] != byte(i) {
+			t.Fatalf("invalid byte %v", i)
+		}
+	}
+
+	r = NewBitStringReader(&s)
+	r.Skip(2)
+	_, err = r.ReadHash256()
+	if err == nil {
+		t.Fatal("expected not enough bits")
+	}
+}
+
+func TestReadCurrencyCollection(t *testing.T) {
+	empty := NewCell()
+	empty.Bits.WriteCoins(1000)
+	empty.Bits.WriteBit(false)
+	r := empty.BeginParse()
+	grams, extra, err := r.ReadCurrencyCollection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grams.Int64() != 1000 || len(extra) != 0 {
+		t.Fatal("invalid currency collection without extra currencies")
+	}
+
+	amounts := map[int64]int64{1: 5, 239: 1 << 40, 0xffffffff: 0}
+	d := NewDictBuilder(32)
+	for id, amount := range amounts {
+		v := NewCell()
+		l := (big.NewInt(amount).BitLen() + 7) / 8
+		v.Bits.WriteUint(l, 5)
+		v.Bits.WriteUint(int(amount), l*8)
+		d.Set(big.NewInt(id), v)
+	}
+	dict, err := d.EndDict()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCell()
+	c.Bits.WriteCoins(7)
+	c.Bits.WriteBit(true)
+	c.AddReference(dict)
+	r = c.BeginParse()
+	grams, extra, err = r.ReadCurrencyCollection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grams.Int64() != 7 || len(extra) != len(amounts) {
+		t.Fatalf("invalid currency collection: %v %v", grams, extra)
+	}
+	for id, amount := range amounts {
+		v, ok := extra[big.NewInt(id).String()]
+		if !ok || v.Int64() != amount {
+			t.Fatalf("invalid amount of currency %v", id)
+		}
+	}
+}
+
+func TestReadCoinsLength(t *testing.T) {
+	max := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 120), big.NewInt(1))
+	s := NewBitString(1023)
+	s.WriteUint(15, 4)
+	s.WriteBigUint(max, 120)
+
+	r := NewBitStringReader(&s)
+	v, err := r.ReadBigCoins()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Cmp(max) != 0 {
+		t.Fatal("invalid max coins amount")
+	}
+
+	r = NewBitStringReader(&s)
+	_, err = r.ReadCoins()
+	if err == nil {
+		t.Fatal("15-byte amount does not fit in uint")
+	}
+
+	truncated := NewBitString(1023)
+	truncated.WriteUint(15, 4)
+	truncated.WriteUint(0, 64)
+	for _, read := range []func(r *BitStringReader) error{
+		func(r *BitStringReader) error { _, err := r.ReadBigCoins(); return err },
+		func(r *BitStringReader) error { _, err := r.ReadCoins(); return err },
+	} {
+		r = NewBitStringReader(&truncated)
+		if read(&r) == nil {
+			t.Fatal("truncated amount must be rejected")
+		}
+	}
+
+	short := NewBitString(1023)
+	short.WriteUint(8, 4)
+	short.WriteUint(1, 64)
+	r = NewBitStringReader(&short)
+	u, err := r.ReadCoins()
+	if err != nil || u != 1 {
+		t.Fatalf("8-byte amount must fit in uint: %v %v", u, err)
+	}
+}
+
+func TestReaderRefs(t *testing.T) {
+	c := NewCell()
+	for i := 0; i < 3; i++ {
+		ref := NewCell()
+		ref.Bits.WriteUint(i+10, 8)
+		c.AddReference(ref)
+	}
+	r := c.BeginParse()
+	if r.RefsCount() != 3 {
+		t.Fatalf("expected 3 refs, got %v", r.RefsCount())
+	}
+	for i := 0; i < r.RefsCount(); i++ {
+		ref, err := r.LoadRef(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mustReadUint(t, &ref, 8) != uint(i+10) {
+			t.Fatalf("invalid ref %v", i)
+		}
+	}
+	if _, err := r.LoadRef(3); err == nil {
+		t.Fatal("expected missing ref error")
+	}
+	if _, err := r.LoadRef(-1); err == nil {
+		t.Fatal("expected missing ref error")
+	}
+
+	s := NewBitString(8)
+	plain := NewBitStringReader(&s)
+	if plain.RefsCount() != 0 {
+		t.Fatal("reader of a bit string has no refs")
+	}
+}
+
+func TestMasterchainAddressRoundTrip(t *testing.T) {
+	// addr_std$10, no anycast, workchain 0xff, then the address
+	raw := bytes.Repeat([]byte{0x77}, 32)
+	s := NewBitString(1023)
+	s.WriteUint(2, 2)
+	s.WriteBit(false)
+	s.WriteUint(0xff, 8)
+	s.WriteBytes(raw)
+
+	r := NewBitStringReader(&s)
+	addr, err := r.ReadAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.Workchain != -1 {
+		t.Fatalf("0xff must be workchain -1, got %v", addr.Workchain)
+	}
+
+	out := NewBitString(1023)
+	err = out.WriteAddress(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !out.Equal(s) {
+		t.Fatal("re-encoded address differs")
+	}
+	wr := NewBitStringReader(&out)
+	wr.Skip(3)
+	if mustReadUint(t, &wr, 8) != 0xff {
+		t.Fatal("workchain byte must be 0xff")
+	}
+
+	if out.WriteAddress(&Address{Workchain: 128, Address: raw}) == nil {
+		t.Fatal("workchain out of int8 range must be rejected")
+	}
+}
+
+func TestReadRemaining(t *testing.T) {
+	c := NewCell()
+	c.Bits.WriteUint(0xabc, 12)
+	c.Bits.WriteUint(0x5, 3)
+
+	r := c.BeginParse()
+	mustReadUint(t, &r, 4)
+	available := r.Available()
+	rest := r.ReadRemaining()
+	if rest.Cursor() != available || rest.Length() != available {
+		t.Fatalf("remaining length is %v, expected %v", rest.Cursor(), available)
+	}
+	if r.Available() != 0 {
+		t.Fatal("reader must be at the end")
+	}
+	if rest.ToBinaryString() != "10111100101" {
+		t.Fatalf("invalid remaining bits %v", rest.ToBinaryString())
+	}
+
+	rest.SetUint(0, 0, 8)
+	if c.Bits.ToBinaryString() != "101010111100101" {
+		t.Fatal("remaining bits must not alias the source cell")
+	}
+}
+
+func TestReadBool(t *testing.T) {
+	s := NewBitString(2)
+	s.WriteBool(true)
+	s.WriteBool(false)
+	err := s.WriteBool(true)
+	if err == nil {
+		t.Fatal("overflow must fail")
+	}
+
+	r := NewBitStringReader(&s)
+	for _, want := range []bool{true, false} {
+		v, err := r.ReadBool()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != want {
+			t.Fatal("invalid flag")
+		}
+	}
+	_, err = r.ReadBool()
+	if err == nil {
+		t.Fatal("reading past the end must fail")
+	}
+}
+
+func TestReadBits(t *testing.T) {
+	c := NewCell()
+	c.Bits.WriteUint(0x5, 3)
+	c.Bits.WriteUint(0x1a2b, 13)
+	c.Bits.WriteUint(0x3, 2)
+
+	r := c.BeginParse()
+	mustReadUint(t, &r, 3)
+	field, err := r.ReadBits(13)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if field.Cursor() != 13 || field.ToBinaryString() != "1101000101011" {
+		t.Fatalf("invalid field %v", field.ToBinaryString())
+	}
+	if mustReadUint(t, &r, 2) != 3 {
+		t.Fatal("reader must stop after the field")
+	}
+	_, err = r.ReadBits(1)
+	if err == nil {
+		t.Fatal("reading past the end must fail")
+	}
+
+	out := NewCell()
+	out.Bits.WriteBit(true)
+	err = out.Bits.WriteBits(&field)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Bits.ToBinaryString() != "11101000101011" {
+		t.Fatalf("invalid written bits %v", out.Bits.ToBinaryString())
+	}
+
+	small := NewBitString(12)
+	err = small.WriteBits(&field)
+	if err == nil {
+		t.Fatal("overflow must fail")
+	}
+	if small.Cursor() != 0 {
+		t.Fatal("failed write must not change the BitString")
+	}
+}
+
+func TestVarInt(t *testing.T) {
+	// VarInteger 32: up to 31 bytes of a signed value
+	hi := new(big.Int).Lsh(big.NewInt(1), 31*8-1)
+	hi.Sub(hi, big.NewInt(1))
+	lo := new(big.Int).Neg(new(big.Int).Lsh(big.NewInt(1), 31*8-1))
+
+	cases := []struct {
+		val  *big.Int
+		size int
+	}{
+		{big.NewInt(0), 0},
+		{big.NewInt(127), 1},
+		{big.NewInt(128), 2},
+		{big.NewInt(-128), 1},
+		{big.NewInt(-129), 2},
+		{big.NewInt(-1), 1},
+		{hi, 31},
+		{lo, 31},
+	}
+	for _, c := range cases {
+		s := NewBitString(1023)
+		err := s.WriteVarInt(c.val, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Cursor() != 5+c.size*8 {
+			t.Fatalf("%v: expected %v bytes, got %v bits", c.val, c.size, s.Cursor())
+		}
+		r := NewBitStringReader(&s)
+		v, err := r.ReadVarInt(5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Cmp(c.val) != 0 {
+			t.Fatalf("expected %v, got %v", c.val, v)
+		}
+	}
+
+	s := NewBitString(1023)
+	err := s.WriteVarInt(new(big.Int).Add(hi, big.NewInt(1)), 5)
+	if err == nil {
+		t.Fatal("too large value must fail")
+	}
+	err = s.WriteVarInt(new(big.Int).Sub(lo, big.NewInt(1)), 5)
+	if err == nil {
+		t.Fatal("too small value must fail")
+	}
+	for _, lenBits := range []int{-1, 0, 32, 64} {
+		err = s.WriteVarInt(big.NewInt(1), lenBits)
+		if err == nil {
+			t.Fatalf("length width %v must be rejected", lenBits)
+		}
+	}
+	if s.Cursor() != 0 {
+		t.Fatal("failed write must not change the BitString")
+	}
+}
+
+func TestReadTag(t *testing.T) {
+	c := NewCell()
+	c.Bits.WriteUint(int(AccountActive), 2)
+	c.Bits.WriteUint(0x7, 4)
+
+	r := c.BeginParse()
+	tag, err := r.ReadTag(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if AccountStatus(tag) != AccountActive {
+		t.Fatalf("invalid status %v", tag)
+	}
+	tag, err = r.ReadTag(4)
+	if err != nil || tag != 0x7 {
+		t.Fatal("invalid 4-bit tag")
+	}
+	_, err = r.ReadTag(1)
+	if err == nil {
+		t.Fatal("reading past the end must fail")
+	}
+	_, err = r.ReadTag(33)
+	if err == nil {
+		t.Fatal("too long tag must fail")
+	}
+}
@@ -1,7 +1,10 @@
 package boc
 
 import (
+	"bytes"
+	"encoding/hex"
 	"fmt"
+	"math/big"
 	"testing"
 )
 
@@ -21,7 +24,10 @@ func TestOn(t *testing.T) {
 
 	var reader = NewBitStringReader(&str)
 
-	var num = reader.ReadCoins()
+	num, err := reader.ReadCoins()
+	if err != nil {
+		t.Fatal(err)
+	}
 	fmt.Println(num)
 
 	//var n = big.NewInt(1)
@@ -46,3 +52,423 @@ func TestOn(t *testing.T) {
 	//str.Print()
 
 }
+
+func writeMessageCell(s *BitString) {
+	addr := Address{Workchain: 0, Address: make([]byte, 32)}
+	s.WriteUint(0x18, 6)
+	s.WriteAddress(&addr)
+	s.WriteCoins(1000000000)
+	s.WriteUint(0, 1+4+4+64+32+1+1)
+	s.WriteUint(0, 32)
+	s.WriteBytes([]byte("hello"))
+}
+
+func TestBitStringWriteNoAllocs(t *testing.T) {
+	s := NewBitString(1023)
+	buf := s.Buffer()
+	allocs := testing.AllocsPerRun(100, func() {
+		s.cursor = 0
+		writeMessageCell(&s)
+	})
+	if allocs != 0 {
+		t.Fatalf("expected no allocations, got %v", allocs)
+	}
+	if &s.Buffer()[0] != &buf[0] {
+		t.Fatal("buffer was reallocated")
+	}
+}
+
+func TestWriteCoinsByteLength(t *testing.T) {
+	s := NewBitString(1023)
+	s.WriteCoins(0x100)
+	r := NewBitStringReader(&s)
+	if mustReadUint(t, &r, 4) != 2 {
+		t.Fatal("0x100 must be stored in 2 bytes")
+	}
+	if mustReadUint(t, &r, 16) != 0x100 {
+		t.Fatal("invalid coins value")
+	}
+}
+
+func BenchmarkBitStringWriteMessage(b *testing.B) {
+	b.ReportAllocs()
+	s := NewBitString(1023)
+	for i := 0; i < b.N; i++ {
+		s.cursor = 0
+		writeMessageCell(&s)
+	}
+}
+
+func TestWriteBytesOverflow(t *testing.T) {
+	s := NewBitString(1023)
+	s.WriteUint(1, 1)
+	err := s.WriteBytes(make([]byte, 200))
+	if err == nil {
+		t.Fatal("expected overflow error")
+	}
+	if s.Cursor() != 1 {
+		t.Fatal("failed write must not move the cursor")
+	}
+
+	err = s.WriteBytes(make([]byte, 127))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.WriteUint(0, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.WriteBit(true) == nil {
+		t.Fatal("expected overflow error after 1023 bits")
+	}
+}
+
+func TestToBinaryString(t *testing.T) {
+	if NewBitString(8).ToBinaryString() != "" {
+		t.Fatal("empty string expected")
+	}
+	s := NewBitString(1023)
+	if s.ToBinaryString() != "" {
+		t.Fatal("empty string expected")
+	}
+	s.WriteUint(5, 3)
+	if s.ToBinaryString() != "101" {
+		t.Fatalf("unexpected bits: %v", s.ToBinaryString())
+	}
+	s.WriteUint(0x5a, 8)
+	s.WriteBit(true)
+	if s.ToBinaryString() != "101"+"01011010"+"1" {
+		t.Fatalf("unexpected bits: %v", s.ToBinaryString())
+	}
+}
+
+func TestBitStringCompare(t *testing.T) {
+	newBits := func(bits string) *BitString {
+		s := NewBitString(1023)
+		for _, b := range bits {
+			s.WriteBit(b == '1')
+		}
+		return &s
+	}
+
+	cases := []struct {
+		a, b string
+		res  int
+	}{
+		{"", "", 0},
+		{"", "0", -1},
+		{"1", "0", 1},
+		{"10110011" + "101", "10110011" + "101", 0},
+		{"10110011" + "100", "10110011" + "101", -1},
+		{"10110011" + "11", "10110011" + "101", 1},
+		{"10110011" + "10", "10110011" + "101", -1},
+		{"0", "10110011", -1},
+	}
+
+	for _, c := range cases {
+		a, b := newBits(c.a), newBits(c.b)
+		if a.Compare(*b) != c.res {
+			t.Fatalf("compare %v and %v: expected %v, got %v", c.a, c.b, c.res, a.Compare(*b))
+		}
+		if b.Compare(*a) != -c.res {
+			t.Fatalf("compare %v and %v is not symmetric", c.b, c.a)
+		}
+		if a.Equal(*b) != (c.res == 0) {
+			t.Fatalf("equal %v and %v", c.a, c.b)
+		}
+	}
+}
+
+func TestBitStringEqualIgnoresUnwrittenBits(t *testing.T) {
+	a := NewBitString(1023)
+	a.WriteUint(0xff, 8)
+	a.cursor = 3
+	b := NewBitString(16)
+	b.WriteUint(7, 3)
+	if !a.Equal(b) {
+		t.Fatal("bits after the cursor must be ignored")
+	}
+	// value receivers work on bit strings that are not addressable
+	if NewBitString(8).Compare(NewBitString(16)) != 0 {
+		t.Fatal("empty bit strings must be equal")
+	}
+}
+
+func TestWriteCoinsStringAndUint64(t *testing.T) {
+	a := NewBitString(1023)
+	err := a.WriteCoinsString("1000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBitString(1023)
+	err = b.WriteCoinsUint64(1000000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewBitString(1023)
+	c.WriteCoins(1000000000)
+	if !a.Equal(c) || !b.Equal(c) {
+		t.Fatal("coins encodings differ")
+	}
+
+	z := NewBitString(1023)
+	err = z.WriteCoinsUint64(0)
+	if err != nil || z.Cursor() != 4 {
+		t.Fatal("zero must be stored as a 4-bit length")
+	}
+
+	for _, amount := range []string{"", "1.5", "ton", "-1", "1329227995784915872903807060280344576"} {
+		s := NewBitString(1023)
+		if s.WriteCoinsString(amount) == nil {
+			t.Fatalf("amount %q must be rejected", amount)
+		}
+	}
+}
+
+func TestZeroWidthWrites(t *testing.T) {
+	s := NewBitString(1023)
+	steps := []func() error{
+		func() error { return s.WriteUint(0, 0) },
+		func() error { return s.WriteUint(0xa, 4) },
+		func() error { return s.WriteBytes(nil) },
+		func() error { return s.WriteBytes([]byte{}) },
+		func() error { return s.WriteBitArray(nil) },
+		func() error { return s.WriteInt(0, 0) },
+		func() error { return s.WriteBigUint(big.NewInt(0), 0) },
+		func() error { return s.WriteBigInt(big.NewInt(0), 0) },
+		func() error { return s.WriteUint(0xb, 4) },
+	}
+	for i, step := range steps {
+		err := step()
+		if err != nil {
+			t.Fatalf("step %v: %v", i, err)
+		}
+	}
+	if s.Cursor() != 8 || s.ToFiftHex() != "AB" {
+		t.Fatalf("zero-width writes changed the output: %v bits, %v", s.Cursor(), s.ToFiftHex())
+	}
+
+	if s.WriteBigUint(big.NewInt(1), 0) == nil || s.WriteInt(1, 0) == nil {
+		t.Fatal("non-zero value must not fit in zero bits")
+	}
+}
+
+func TestSetUint(t *testing.T) {
+	s := NewBitString(1023)
+	s.WriteUint(0xff, 8)
+	s.WriteUint(0, 32)
+	s.WriteUint(0xee, 8)
+
+	err := s.SetUint(8, 0x12345678, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ToFiftHex() != "FF12345678EE" || s.Cursor() != 48 {
+		t.Fatalf("invalid patched bits %v", s.ToFiftHex())
+	}
+
+	if s.SetUint(40, 0, 16) == nil {
+		t.Fatal("region beyond the written bits must be rejected")
+	}
+	if s.SetUint(0, 0x100, 8) == nil {
+		t.Fatal("value wider than the field must be rejected")
+	}
+	err = s.SetUint(0, 0, 65)
+	if err == nil || err.Error() != "bit length must be at most 64" {
+		t.Fatalf("field wider than 64 bits must be rejected, got %v", err)
+	}
+}
+
+func TestBitwiseOps(t *testing.T) {
+	a := NewBitString(11)
+	a.WriteBitArray([]bool{true, true, false, false, true, false, true, false, true, true, false})
+	b := NewBitString(11)
+	b.WriteBitArray([]bool{true, false, true, false, true, true, false, false, false, true, true})
+
+	cases := []struct {
+		op   func(BitString) (BitString, error)
+		want string
+	}{
+		{a.And, "10001000010"},
+		{a.Or, "11101110111"},
+		{a.Xor, "01100110101"},
+	}
+	for _, c := range cases {
+		res, err := c.op(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.ToBinaryString() != c.want {
+			t.Fatalf("got %v, want %v", res.ToBinaryString(), c.want)
+		}
+	}
+
+	short := NewBitString(10)
+	short.WriteUint(0, 10)
+	_, err := a.And(short)
+	if err == nil {
+		t.Fatal("length mismatch must be rejected")
+	}
+	// value receivers work on bit strings that are not addressable
+	empty, err := NewBitString(8).Xor(NewBitString(16))
+	if err != nil || empty.Cursor() != 0 {
+		t.Fatal("xor of empty bit strings must be empty")
+	}
+}
+
+func TestWriteInvalidBitLength(t *testing.T) {
+	for _, bitLen := range []int{-1, 1 << 30} {
+		s := NewBitString(64)
+		if s.WriteUint(0, bitLen) == nil {
+			t.Fatalf("WriteUint(%v) must fail", bitLen)
+		}
+		if s.WriteInt(0, bitLen) == nil {
+			t.Fatalf("WriteInt(%v) must fail", bitLen)
+		}
+		if s.WriteBigUint(big.NewInt(0), bitLen) == nil {
+			t.Fatalf("WriteBigUint(%v) must fail", bitLen)
+		}
+		if s.WriteBigInt(big.NewInt(0), bitLen) == nil {
+			t.Fatalf("WriteBigInt(%v) must fail", bitLen)
+		}
+		if s.Cursor() != 0 {
+			t.Fatal("failed writes must not move the cursor")
+		}
+	}
+}
+
+func TestWriteAddressNone(t *testing.T) {
+	addr := Address{Workchain: -1, Address: bytes.Repeat([]byte{0x33}, 32)}
+	c := NewCell()
+	c.Bits.WriteAddressNone()
+	c.Bits.WriteAddress(&addr)
+	c.Bits.WriteAddress(nil)
+	if c.BitSize() != 2+267+2 {
+		t.Fatalf("invalid bit size %v", c.BitSize())
+	}
+
+	r := c.BeginParse()
+	for i, want := range []*Address{nil, &addr, nil} {
+		got, err := r.ReadAddress()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (got == nil) != (want == nil) {
+			t.Fatalf("address %v: expected %v, got %v", i, want, got)
+		}
+		if got != nil && (got.Workchain != want.Workchain || !bytes.Equal(got.Address, want.Address)) {
+			t.Fatalf("address %v is invalid", i)
+		}
+	}
+
+	s := NewBitString(1023)
+	if s.WriteAddress(&Address{Address: make([]byte, 20)}) == nil {
+		t.Fatal("short address must be rejected")
+	}
+}
+
+func TestSetTopUppedArray(t *testing.T) {
+	s := NewBitString(0)
+	err := s.SetTopUppedArray([]byte{0xab, 0xc8}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Cursor() != 12 || s.ToFiftHex() != "ABC" {
+		t.Fatalf("invalid bits %v of %v", s.ToFiftHex(), s.Cursor())
+	}
+
+	for _, bad := range [][]byte{{0xab, 0x00}, {0xab, 0x80}} {
+		s = NewBitString(0)
+		if s.SetTopUppedArray(bad, false) == nil {
+			t.Fatalf("bad completion byte %x must be rejected", bad[1])
+		}
+	}
+
+	// a cell with a partial data byte and no completion bit
+	data, _ := hex.DecodeString("b5ee9c72010101010003000001" + "00")
+	_, err = DeserializeBoc(data)
+	if err == nil {
+		t.Fatal("cell without completion bit must be rejected")
+	}
+}
+
+func TestBitsRoundTrip(t *testing.T) {
+	for n := 0; n <= 16; n++ {
+		s := NewBitString(16)
+		s.WriteUint(0xb5a3>>(16-n), n)
+
+		bools := s.Bits()
+		if len(bools) != n {
+			t.Fatalf("%v: expected %v bits, got %v", n, n, len(bools))
+		}
+		for i, b := range bools {
+			if b != s.Get(i) {
+				t.Fatalf("%v: invalid bit %v", n, i)
+			}
+		}
+
+		res := BitStringFromBools(bools)
+		if res.Cursor() != n || res.Length() != n {
+			t.Fatalf("%v: invalid length", n)
+		}
+		if !bytes.Equal(res.Buffer(), s.Buffer()[:(n+7)/8]) {
+			t.Fatalf("%v: buffers differ: %x %x", n, res.Buffer(), s.Buffer())
+		}
+	}
+}
+
+func TestGetTopUppedArrayBoundaries(t *testing.T) {
+	cases := []struct {
+		bits int
+		size int
+	}{
+		{0, 0}, {1, 1}, {7, 1}, {8, 1}, {9, 2}, {16, 2}, {24, 3}, {1016, 127}, {1017, 128}, {1023, 128},
+	}
+	for _, c := range cases {
+		s := NewBitString(1023)
+		for i := 0; i < c.bits; i++ {
+			s.WriteBit(true)
+		}
+		data, err := s.GetTopUppedArray()
+		if err != nil {
+			t.Fatalf("%v bits: %v", c.bits, err)
+		}
+		if len(data) != c.size {
+			t.Fatalf("%v bits: expected %v bytes, got %v", c.bits, c.size, len(data))
+		}
+		if c.bits%8 == 0 {
+			for _, b := range data {
+				if b != 0xff {
+					t.Fatalf("%v bits: full bytes must not get a completion bit", c.bits)
+				}
+			}
+		}
+
+		res := NewBitString(0)
+		err = res.SetTopUppedArray(data, c.bits%8 == 0)
+		if err != nil {
+			t.Fatalf("%v bits: %v", c.bits, err)
+		}
+		if res.Cursor() != c.bits {
+			t.Fatalf("%v bits: round-trip gave %v bits", c.bits, res.Cursor())
+		}
+	}
+
+	full := NewBitString(1023)
+	for i := 0; i < 1023; i++ {
+		full.WriteBit(true)
+	}
+	data, _ := full.GetTopUppedArray()
+	if data[127] != 0xff {
+		t.Fatalf("1023 bits must end with the completion bit, got %x", data[127])
+	}
+
+	// bits after the cursor are ignored
+	dirty := NewBitString(16)
+	dirty.WriteUint(0xffff, 16)
+	dirty.cursor = 3
+	data, _ = dirty.GetTopUppedArray()
+	if !bytes.Equal(data, []byte{0xf0}) {
+		t.Fatalf("invalid data %x", data)
+	}
+}
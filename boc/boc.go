@@ -1,13 +1,18 @@
 package boc
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"hash/crc32"
 	"math"
 	"math/bits"
+	"strings"
 )
 
 var reachBocMagicPrefix = []byte{
@@ -24,6 +29,10 @@ var leanBocMagicPrefixCRC = []byte{
 
 var crcTable = crc32.MakeTable(crc32.Castagnoli)
 
+// ErrBrokenTopology is returned when a cell references a cell that does not
+// come after it in the boc.
+var ErrBrokenTopology = errors.New("topological order is broken")
+
 func ByteArrayEquals(a []byte, b []byte) bool {
 	if len(a) != len(b) {
 		return false
@@ -58,15 +67,34 @@ type bocHeader struct {
 	rootList     []uint
 	index        []uint
 	cellsData    []byte
+	// cellsOffset is the position of cellsData in the boc
+	cellsOffset int
+	// cacheBits holds the cache bit of every index entry when hasCacheBits is set
+	cacheBits []bool
 }
 
 func parseBocHeader(boc []byte) (*bocHeader, error) {
+	header, consumed, err := parseBocHeaderPrefix(boc)
+	if err != nil {
+		return nil, err
+	}
+	if consumed < len(boc) {
+		return nil, fmt.Errorf("too much bytes in provided boc at offset %v", consumed)
+	}
+	return header, nil
+}
 
-	var originalBoc = make([]byte, len(boc))
-	copy(originalBoc, boc)
+// parseBocHeaderPrefix parses a boc at the start of data and returns the number of
+// bytes it takes. The rest of data is ignored.
+func parseBocHeaderPrefix(boc []byte) (*bocHeader, int, error) {
+	var originalBoc = boc
+	// pos returns the offset of the current position in the boc, for errors
+	pos := func() int {
+		return len(originalBoc) - len(boc)
+	}
 
 	if len(boc) < 4+1 {
-		return nil, errors.New("not enough bytes for magic prefix")
+		return nil, 0, fmt.Errorf("not enough bytes for magic prefix at offset %v", pos())
 	}
 
 	var prefix = boc[0:4]
@@ -83,7 +111,7 @@ func parseBocHeader(boc []byte) (*bocHeader, error) {
 		hasIdx = (flagsByte & 128) > 0
 		hashCrc32 = (flagsByte & 64) > 0
 		hasCacheBits = (flagsByte & 32) > 0
-		flags = int((flagsByte&16)*2 + (flagsByte & 8))
+		flags = int((flagsByte >> 3) & 3)
 		sizeBytes = int(flagsByte % 8)
 	} else if ByteArrayEquals(prefix, leanBocMagicPrefix) {
 		hasIdx = true
@@ -98,16 +126,25 @@ func parseBocHeader(boc []byte) (*bocHeader, error) {
 		flags = 0
 		sizeBytes = int(boc[0])
 	} else {
-		return nil, errors.New("unknown magic prefix")
+		return nil, 0, fmt.Errorf("unknown magic prefix at offset %v", pos())
 	}
 
 	boc = boc[1:]
-	if len(boc) < 1+5*sizeBytes {
-		return nil, errors.New("not enough bytes for encoding cells counters")
+	if sizeBytes < 1 || sizeBytes > 4 {
+		return nil, 0, fmt.Errorf("invalid ref size %v at offset %v", sizeBytes, pos()-1)
+	}
+	if len(boc) < 1 {
+		return nil, 0, fmt.Errorf("not enough bytes for offset size at offset %v", pos())
 	}
 
 	offsetBytes := int(boc[0])
+	if offsetBytes < 1 || offsetBytes > 8 {
+		return nil, 0, fmt.Errorf("invalid offset size %v at offset %v", offsetBytes, pos())
+	}
 	boc = boc[1:]
+	if len(boc) < 3*sizeBytes+offsetBytes {
+		return nil, 0, fmt.Errorf("not enough bytes for encoding cells counters at offset %v", pos())
+	}
 	cellsNum := readNBytesUIntFromArray(sizeBytes, boc)
 	boc = boc[sizeBytes:]
 	rootsNum := readNBytesUIntFromArray(sizeBytes, boc)
@@ -116,52 +153,67 @@ func parseBocHeader(boc []byte) (*bocHeader, error) {
 	boc = boc[sizeBytes:]
 	totCellsSize := readNBytesUIntFromArray(offsetBytes, boc)
 	boc = boc[offsetBytes:]
-
-	if len(boc) < int(rootsNum)*sizeBytes {
-		return nil, errors.New("not enough bytes for encoding root cells hashes")
+	// every cell takes at least its two descriptor bytes
+	if uint64(cellsNum)*2 > uint64(totCellsSize) {
+		return nil, 0, fmt.Errorf("%v cells do not fit in %v bytes of cells data", cellsNum, totCellsSize)
 	}
 
 	// Roots
 	rootList := make([]uint, 0)
-	for i := 0; i < int(rootsNum); i++ {
-		rootList = append(rootList, readNBytesUIntFromArray(sizeBytes, boc))
-		boc = boc[sizeBytes:]
+	if ByteArrayEquals(prefix, reachBocMagicPrefix) {
+		if len(boc) < int(rootsNum)*sizeBytes {
+			return nil, 0, fmt.Errorf("not enough bytes for encoding root cells hashes at offset %v", pos())
+		}
+		for i := 0; i < int(rootsNum); i++ {
+			rootList = append(rootList, readNBytesUIntFromArray(sizeBytes, boc))
+			boc = boc[sizeBytes:]
+		}
+	} else {
+		// lean formats have a single root, the first cell, and no root list
+		if rootsNum != 1 {
+			return nil, 0, fmt.Errorf("lean boc must have exactly one root at offset %v", pos())
+		}
+		rootList = append(rootList, 0)
 	}
 
 	// Index
 	index := make([]uint, 0)
+	cacheBits := make([]bool, 0)
 	if hasIdx {
 		if len(boc) < offsetBytes*int(cellsNum) {
-			return nil, errors.New("not enough bytes for index encoding")
+			return nil, 0, fmt.Errorf("not enough bytes for index encoding at offset %v", pos())
 		}
 		for i := 0; i < int(cellsNum); i++ {
-			index = append(index, readNBytesUIntFromArray(offsetBytes, boc))
+			offset := readNBytesUIntFromArray(offsetBytes, boc)
+			if hasCacheBits {
+				// the lowest bit of an entry is the cache bit
+				cacheBits = append(cacheBits, offset&1 == 1)
+				offset >>= 1
+			}
+			index = append(index, offset)
 			boc = boc[offsetBytes:]
 		}
 	}
 
 	// Cells
-	if len(boc) < int(totCellsSize) {
-		return nil, errors.New("not enough bytes for cells data")
+	if uint(len(boc)) < totCellsSize {
+		return nil, 0, fmt.Errorf("not enough bytes for cells data at offset %v", pos())
 	}
 
+	cellsOffset := pos()
 	cellsData := boc[0:totCellsSize]
 	boc = boc[totCellsSize:]
 
 	if hashCrc32 {
 		if len(boc) < 4 {
-			return nil, errors.New("not enough bytes for crc32c hashsum")
+			return nil, 0, fmt.Errorf("not enough bytes for crc32c hashsum at offset %v", pos())
 		}
-		if binary.LittleEndian.Uint32(boc[0:4]) != crc32.Checksum(originalBoc[0:len(originalBoc)-4], crcTable) {
-			return nil, errors.New("crc32c hashsum mismatch")
+		if binary.LittleEndian.Uint32(boc[0:4]) != crc32.Checksum(originalBoc[0:pos()], crcTable) {
+			return nil, 0, fmt.Errorf("crc32c hashsum mismatch at offset %v", pos())
 		}
 		boc = boc[4:]
 	}
 
-	if len(boc) > 0 {
-		return nil, errors.New("too much bytes in provided boc")
-	}
-
 	return &bocHeader{
 		hasIdx,
 		hashCrc32,
@@ -175,79 +227,370 @@ func parseBocHeader(boc []byte) (*bocHeader, error) {
 		rootList,
 		index,
 		cellsData,
-	}, nil
+		cellsOffset,
+		cacheBits,
+	}, len(originalBoc) - len(boc), nil
 }
 
-func deserializeCellData(cellData []byte, referenceIndexSize int) (*Cell, []int, []byte, error) {
+// rawCell is a cell as stored in a boc, with refs given by cell positions.
+type rawCell struct {
+	isExotic        bool
+	data            []byte
+	fullfilledBytes bool
+	refs            []int
+}
+
+// readRawCell reads one cell from cellData without decoding its data and returns
+// the rest of cellData.
+func readRawCell(cellData []byte, referenceIndexSize int) (*rawCell, []byte, error) {
 	if len(cellData) < 2 {
-		return nil, nil, nil, errors.New("not enough bytes to encode cell descriptors")
+		return nil, nil, errors.New("not enough bytes to encode cell descriptors")
 	}
 
 	d1 := cellData[0]
 	d2 := cellData[1]
 	cellData = cellData[2:]
 
-	isExotic := (d1 & 8) > 0
 	refNum := int(d1 % 8)
 	dataBytesSize := int(math.Ceil(float64(d2) / float64(2)))
-	fullfilledBytes := !((d2 % 2) > 0)
 
+	if refNum > 4 {
+		return nil, nil, fmt.Errorf("invalid refs count %v in cell descriptor", refNum)
+	}
+	if len(cellData) < dataBytesSize {
+		return nil, nil, fmt.Errorf("not enough bytes for cell data: need %v, have %v", dataBytesSize, len(cellData))
+	}
+
+	res := rawCell{
+		isExotic:        (d1 & 8) > 0,
+		data:            cellData[0:dataBytesSize],
+		fullfilledBytes: !((d2 % 2) > 0),
+		refs:            make([]int, 0, refNum),
+	}
+	cellData = cellData[dataBytesSize:]
+
+	for i := 0; i < refNum; i++ {
+		if len(cellData) < referenceIndexSize {
+			return nil, nil, fmt.Errorf("not enough bytes for cell ref %v: need %v, have %v", i, referenceIndexSize, len(cellData))
+		}
+		res.refs = append(res.refs, int(readNBytesUIntFromArray(referenceIndexSize, cellData)))
+		cellData = cellData[referenceIndexSize:]
+	}
+
+	return &res, cellData, nil
+}
+
+func deserializeCellData(cellData []byte, referenceIndexSize int) (*Cell, []int, []byte, error) {
+	raw, residue, err := readRawCell(cellData, referenceIndexSize)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cell, err := cellFromRaw(raw)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return cell, raw.refs, residue, nil
+}
+
+// cellFromRaw builds a cell with the data of raw and no refs.
+func cellFromRaw(raw *rawCell) (*Cell, error) {
 	var cell *Cell
-	if isExotic {
+	if raw.isExotic {
 		cell = NewCellExotic()
 	} else {
 		cell = NewCell()
 	}
-	var refs = make([]int, 0)
+	err := cell.Bits.SetTopUppedArray(raw.data, raw.fullfilledBytes)
+	if err != nil {
+		return nil, err
+	}
+	return cell, nil
+}
+
+// ctxCheckInterval is the number of cells processed between context checks.
+const ctxCheckInterval = 1024
+
+func DeserializeBoc(boc []byte) ([]*Cell, error) {
+	return deserializeBoc(context.Background(), boc, nil)
+}
+
+// DeserializeBocContext works like DeserializeBoc but stops with ctx.Err() once
+// the context is done.
+func DeserializeBocContext(ctx context.Context, boc []byte) ([]*Cell, error) {
+	return deserializeBoc(ctx, boc, nil)
+}
+
+// DeserializeBocWithCache works like DeserializeBoc but returns cells already
+// present in the cache instead of creating new ones. Cells shared through the
+// cache must not be modified.
+func DeserializeBocWithCache(boc []byte, cache *CellCache) ([]*Cell, error) {
+	return deserializeBoc(context.Background(), boc, cache)
+}
 
-	if len(cellData) < dataBytesSize+referenceIndexSize*refNum {
-		return nil, nil, nil, errors.New("not enough bytes to encode cell data")
+// DeserializeBocWithLibraries works like DeserializeBoc but replaces every library
+// cell with the cell returned by resolve for its hash. Resolved cells are expanded
+// the same way and must have the requested hash.
+func DeserializeBocWithLibraries(boc []byte, resolve func(hash []byte) (*Cell, error)) ([]*Cell, error) {
+	roots, err := DeserializeBoc(boc)
+	if err != nil {
+		return nil, err
+	}
+	var expand func(c *Cell) (*Cell, error)
+	expand = func(c *Cell) (*Cell, error) {
+		if c.Type() != LibraryCell {
+			return c, nil
+		}
+		if c.BitSize() != 8+256 {
+			return nil, errors.New("invalid library cell")
+		}
+		hash := c.Bits.buf[1:33]
+		lib, err := resolve(hash)
+		if err != nil {
+			return nil, err
+		}
+		if lib == nil || !HashEqual(lib.Hash(), hash) {
+			return nil, fmt.Errorf("library %x resolved to a cell with another hash", hash)
+		}
+		return lib.Map(expand)
+	}
+	for i, root := range roots {
+		roots[i], err = root.Map(expand)
+		if err != nil {
+			return nil, err
+		}
 	}
+	return roots, nil
+}
 
-	cell.Bits.SetTopUppedArray(cellData[0:dataBytesSize], fullfilledBytes)
-	cellData = cellData[dataBytesSize:]
+// DeserializeBocForEach calls fn for every cell in boc order without keeping the
+// cells. Refs of a cell always point to cells later in the boc, so the cells passed
+// to fn have their data but no refs; refs holds the boc indexes of the refs instead.
+// Hash and other methods depending on refs are meaningless on these cells; use
+// DeserializeBocOrdered to get them linked. The boc structure is checked before the
+// first call. An error returned by fn stops the iteration and is returned as is.
+func DeserializeBocForEach(boc []byte, fn func(index int, c *Cell, refs []int) error) error {
+	header, err := parseBocHeader(boc)
+	if err != nil {
+		return err
+	}
+	raws, err := checkBocCells(context.Background(), header)
+	if err != nil {
+		return err
+	}
 
-	for i := 0; i < refNum; i++ {
-		refs = append(refs, int(readNBytesUIntFromArray(referenceIndexSize, cellData)))
-		cellData = cellData[referenceIndexSize:]
+	for i, raw := range raws {
+		cell, err := cellFromRaw(raw)
+		if err != nil {
+			return err
+		}
+		err = fn(i, cell, raw.refs)
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	return cell, refs, cellData, nil
+// DeserializeBocPrefix deserializes a boc at the start of data and returns its roots
+// and the number of bytes the boc takes. Bytes after the boc are not an error.
+func DeserializeBocPrefix(data []byte) ([]*Cell, int, error) {
+	header, consumed, err := parseBocHeaderPrefix(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	roots, _, err := deserializeBocCells(context.Background(), header, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	return roots, consumed, nil
 }
 
-func DeserializeBoc(boc []byte) ([]*Cell, error) {
-	header, _ := parseBocHeader(boc)
+// DeserializeBocOrdered returns all cells in the order the boc stores them and the
+// positions of the roots in that list. Passing them to SerializeBocOrdered with the
+// options of the boc gives the same bytes for bocs using the minimal size fields.
+func DeserializeBocOrdered(boc []byte) ([]*Cell, []int, error) {
+	header, err := parseBocHeader(boc)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, cells, err := deserializeBocCells(context.Background(), header, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	rootIndices := make([]int, 0, len(header.rootList))
+	for _, item := range header.rootList {
+		rootIndices = append(rootIndices, int(item))
+	}
+	return cells, rootIndices, nil
+}
 
-	cellsData := header.cellsData
-	cellsArray := make([]*Cell, 0)
-	refsArray := make([][]int, 0)
+func deserializeBoc(ctx context.Context, boc []byte, cache *CellCache) ([]*Cell, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	for i := 0; i < int(header.cellsNum); i++ {
-		cell, refs, residue, _ := deserializeCellData(cellsData, header.sizeBytes)
-		cellsData = residue
-		cellsArray = append(cellsArray, cell)
-		refsArray = append(refsArray, refs)
+	header, err := parseBocHeader(boc)
+	if err != nil {
+		return nil, err
 	}
+	roots, _, err := deserializeBocCells(ctx, header, cache)
+	return roots, err
+}
 
-	for i := int(header.cellsNum - 1); i >= 0; i-- {
-		c := refsArray[i]
+// deserializeBocCells returns the roots and all cells in boc order.
+func deserializeBocCells(ctx context.Context, header *bocHeader, cache *CellCache) ([]*Cell, []*Cell, error) {
+	raws, err := checkBocCells(ctx, header)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		for ri := 0; ri < len(c); ri++ {
-			r := c[ri]
-			if r < i {
-				return nil, errors.New("topological order is broken")
+	// refs point to later cells only, so building from the end links every
+	// cell to already built refs
+	cellsArray := make([]*Cell, len(raws))
+	memo := map[*Cell]*cellHashes{}
+	for i := len(raws) - 1; i >= 0; i-- {
+		if i%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, nil, err
 			}
-			cellsArray[i].refs[ri] = cellsArray[r]
 		}
+		cell, err := cellFromRaw(raws[i])
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w (cell %v)", err, i)
+		}
+		for _, r := range raws[i].refs {
+			cell.refs = append(cell.refs, cellsArray[r])
+		}
+
+		// refs are linked to already interned cells, so the hash is final here
+		if cache != nil {
+			cell = cache.intern(cell, memo)
+		}
+		cellsArray[i] = cell
 	}
 
 	rootCells := make([]*Cell, 0)
 
+	// cells from the cache may be shared with other bocs, so they don't get the header info
+	var bocOptions *BocSerializeOptions
+	if cache == nil {
+		bocOptions = &BocSerializeOptions{
+			Idx:       header.hasIdx,
+			HasCrc32:  header.hashCrc32,
+			CacheBits: header.hasCacheBits,
+			Flags:     header.flags,
+		}
+	}
+
 	for _, item := range header.rootList {
-		rootCells = append(rootCells, cellsArray[item])
+		root := cellsArray[item]
+		if bocOptions != nil {
+			root.bocOptions = bocOptions
+		}
+		rootCells = append(rootCells, root)
+	}
+
+	return rootCells, cellsArray, nil
+}
+
+// checkCacheBits checks that only cells referenced more than once are marked as
+// worth caching. refsArray holds the ref positions of every cell.
+func checkCacheBits(header *bocHeader, refsArray [][]int) error {
+	if len(header.cacheBits) == 0 {
+		return nil
+	}
+	// a root list entry references its cell the same way a ref does
+	parents := make([]int, len(refsArray))
+	for _, r := range header.rootList {
+		if int(r) < len(parents) {
+			parents[r]++
+		}
+	}
+	for _, refs := range refsArray {
+		for _, r := range refs {
+			parents[r]++
+		}
+	}
+	for i, cached := range header.cacheBits {
+		if cached && parents[i] < 2 {
+			return fmt.Errorf("cell %v has the cache bit set but %v parents", i, parents[i])
+		}
+	}
+	return nil
+}
+
+// RootCount returns the number of roots of a boc. It checks the header and the
+// structure of all cells, like DeserializeBoc does, but doesn't build them.
+func RootCount(boc []byte) (int, error) {
+	header, err := parseBocHeader(boc)
+	if err != nil {
+		return 0, err
+	}
+	_, err = checkBocCells(context.Background(), header)
+	if err != nil {
+		return 0, err
+	}
+	return len(header.rootList), nil
+}
+
+// IsValidBoc reports whether RootCount accepts the boc.
+func IsValidBoc(boc []byte) bool {
+	_, err := RootCount(boc)
+	return err == nil
+}
+
+// checkBocCells checks the structure of all cells of a boc and returns them as raw
+// cells: data, refs pointing to later cells only, cache bits and the root list.
+// Cells are built from the result only after the whole boc passed the checks.
+func checkBocCells(ctx context.Context, header *bocHeader) ([]*rawCell, error) {
+	// Absent cells are stored as hash-only placeholders, so decoding them as
+	// ordinary cells would silently produce wrong trees.
+	if header.absentNum > 0 {
+		return nil, errors.New("absent cells are not supported")
+	}
+
+	cellsData := header.cellsData
+	raws := make([]*rawCell, 0, header.cellsNum)
+	refsArray := make([][]int, 0, header.cellsNum)
+	for i := 0; i < int(header.cellsNum); i++ {
+		if i%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		raw, residue, err := readRawCell(cellsData, header.sizeBytes)
+		if err == nil && !raw.fullfilledBytes && len(raw.data) > 0 {
+			_, err = topUppedPadding(raw.data[len(raw.data)-1])
+		}
+		if err != nil {
+			offset := header.cellsOffset + len(header.cellsData) - len(cellsData)
+			return nil, fmt.Errorf("%w at offset %v (cell %v)", err, offset, i)
+		}
+		cellsData = residue
+
+		for ri, r := range raw.refs {
+			if r >= int(header.cellsNum) {
+				return nil, fmt.Errorf("cell %v ref %v points to missing cell %v", i, ri, r)
+			}
+			if r <= i {
+				return nil, fmt.Errorf("%w: cell %v ref %v points to cell %v", ErrBrokenTopology, i, ri, r)
+			}
+		}
+		raws = append(raws, raw)
+		refsArray = append(refsArray, raw.refs)
+	}
+
+	err := checkCacheBits(header, refsArray)
+	if err != nil {
+		return nil, err
 	}
 
-	return rootCells, nil
+	for _, item := range header.rootList {
+		if item >= header.cellsNum {
+			return nil, fmt.Errorf("root index %v is out of range", item)
+		}
+	}
+	return raws, nil
 }
 
 func DeserializeBocBase64(boc string) ([]*Cell, error) {
@@ -258,140 +601,440 @@ func DeserializeBocBase64(boc string) ([]*Cell, error) {
 	return DeserializeBoc(bocData)
 }
 
-func getMaxDepth(cell *Cell) int {
-	maxDepth := 0
-	if cell.RefsSize() > 0 {
-		for _, ref := range cell.Refs() {
-			if getMaxDepth(ref) > maxDepth {
-				maxDepth = getMaxDepth(ref)
-			}
-		}
-		maxDepth += 1
+// DeserializeBocBase64URL decodes URL-safe base64, with or without padding.
+func DeserializeBocBase64URL(boc string) ([]*Cell, error) {
+	bocData, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(boc, "="))
+	if err != nil {
+		return nil, err
 	}
-	return maxDepth
+	return DeserializeBoc(bocData)
 }
 
-func bocReprWithoutRefs(cell *Cell) []byte {
-	d1 := byte(cell.RefsSize())
-	d2 := byte((cell.BitSize()+7)/8 + cell.BitSize()/8)
-
-	res := make([]byte, ((cell.BitSize()+7)/8)+2)
-	res[0] = d1
-	res[1] = d2
-	copy(res[2:], cell.Bits.buf)
+// BocEqual reports whether two BOCs have the same roots, in the same order,
+// comparing root hashes. Flags, index and cache bits don't affect the result.
+func BocEqual(a, b []byte) (bool, error) {
+	rootsA, err := DeserializeBoc(a)
+	if err != nil {
+		return false, err
+	}
+	rootsB, err := DeserializeBoc(b)
+	if err != nil {
+		return false, err
+	}
+	if len(rootsA) != len(rootsB) {
+		return false, nil
+	}
+	for i := range rootsA {
+		if !bytes.Equal(rootsA[i].Hash(), rootsB[i].Hash()) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
 
-	if cell.BitSize()%8 != 0 {
-		res[len(res)-1] |= 1 << (7 - cell.BitSize()%8)
+// cellDescriptors returns d1 and d2 of a cell. The same descriptors are written to
+// a boc and hashed, so both must be built here.
+func cellDescriptors(refsNum int, isExotic bool, levelMask int, bitLen int) (byte, byte) {
+	d1 := byte(refsNum) | byte(levelMask)<<5
+	if isExotic {
+		d1 |= 8
 	}
+	d2 := byte((bitLen+7)/8 + bitLen/8)
+	return d1, d2
+}
 
-	return res
+func bocReprWithoutRefs(cell *Cell, levelMask int) []byte {
+	d1, d2 := cellDescriptors(cell.RefsSize(), cell.IsExotic(), levelMask, cell.BitSize())
+	data, _ := cell.DataBytes()
+	return append([]byte{d1, d2}, data...)
 }
 
+// hashRepr returns the representation hashed for the representation hash of the
+// cell: descriptors, data or the previous level hash, then depths and hashes of the refs.
 func hashRepr(cell *Cell) []byte {
-	res := bocReprWithoutRefs(cell)
-	for _, r := range cell.Refs() {
-		depthRepr := make([]byte, 2)
-		binary.BigEndian.PutUint16(depthRepr, uint16(getMaxDepth(r)))
-		res = append(res, depthRepr...)
-	}
-	for _, r := range cell.Refs() {
-		res = append(res, r.Hash()...)
+	memo := map[*Cell]*cellHashes{}
+	h := computeCellHashes(cell, memo)
+	refs := make([]*cellHashes, len(cell.refs))
+	for i, ref := range cell.refs {
+		refs[i] = memo[ref]
 	}
-	return res
+	level := h.level()
+	var buf bytes.Buffer
+	writeLevelRepr(&buf, cell, h, refs, level, h.index(level) == 0 || cell.Type() == PrunedBranchCell)
+	return buf.Bytes()
 }
 
+// newCellHasher creates the hash used for cell hashes. Tests may replace it to check
+// dedup and ordering with predictable hashes; the result is truncated or padded to 32 bytes.
+var newCellHasher = sha256.New
+
 func hashCell(cell *Cell) []byte {
-	hash := sha256.Sum256(hashRepr(cell))
+	hash := computeCellHashes(cell, map[*Cell]*cellHashes{}).hash(maxLevel)
 	return hash[:]
 }
 
-func topologicalSortImpl(cell *Cell, seen map[string]bool) ([]*Cell, error) {
-	var res = make([]*Cell, 0)
+// HashCellRepr computes the hash of an ordinary cell from its data and the depths and
+// hashes of its refs, without building a Cell. The result equals Cell.Hash.
+func HashCellRepr(bits []byte, bitLen int, refHashes [][]byte, refDepths []uint16) ([]byte, error) {
+	if bitLen < 0 || bitLen > 1023 || bitLen > len(bits)*8 {
+		return nil, errors.New("invalid cell bit length")
+	}
+	if len(refHashes) > 4 || len(refHashes) != len(refDepths) {
+		return nil, errors.New("invalid cell refs")
+	}
+
+	h := newCellHasher()
+	var scratch [2]byte
+	scratch[0], scratch[1] = cellDescriptors(len(refHashes), false, 0, bitLen)
+	h.Write(scratch[:])
+
+	h.Write(bits[:bitLen/8])
+	if rem := bitLen % 8; rem != 0 {
+		scratch[0] = bits[bitLen/8]&(0xff<<(8-rem)) | 1<<(7-rem)
+		h.Write(scratch[:1])
+	}
 
-	res = append(res, cell)
+	for _, d := range refDepths {
+		binary.BigEndian.PutUint16(scratch[:], d)
+		h.Write(scratch[:])
+	}
+	for _, hash := range refHashes {
+		if len(hash) != 32 {
+			return nil, errors.New("ref hash must be 32 bytes long")
+		}
+		h.Write(hash)
+	}
+	return h.Sum(nil), nil
+}
+
+func memoHashString(cell *Cell, memo map[*Cell]*cellHashes) string {
+	hash := computeCellHashes(cell, memo).hash(maxLevel)
+	return hex.EncodeToString(hash[:])
+}
 
-	hash := cell.HashString()
-	if seen[hash] == true {
-		return nil, errors.New("circular references are not allowed")
+// topologicalSortImpl appends cells in DFS post-order visiting refs from last to
+// first, so the reversed result is pre-order for trees. Cells with equal hashes
+// are visited once. memo keeps cell hashes, so every cell is hashed once.
+func topologicalSortImpl(cell *Cell, seen map[string]bool, memo map[*Cell]*cellHashes, res *[]*Cell) {
+	hash := memoHashString(cell, memo)
+	if seen[hash] {
+		return
 	}
 	seen[hash] = true
 
-	for _, ref := range cell.Refs() {
-		res2, err := topologicalSortImpl(ref, seen)
-		if err != nil {
-			return nil, err
-		}
-		res = append(res, res2...)
+	refs := cell.Refs()
+	for i := len(refs) - 1; i >= 0; i-- {
+		topologicalSortImpl(refs[i], seen, memo, res)
 	}
 
-	return res, nil
+	*res = append(*res, cell)
 }
 
-func topologicalSort(cell *Cell) ([]*Cell, map[string]int, error) {
-	res, err := topologicalSortImpl(cell, map[string]bool{})
-	if err != nil {
-		return nil, nil, err
+// topologicalSort returns deduplicated cells ordered so that every cell goes before
+// its refs, and a map from cell hash to index in that order.
+func topologicalSort(cell *Cell) ([]*Cell, map[string]int) {
+	return topologicalSortRoots([]*Cell{cell})
+}
+
+// topologicalSortRoots is topologicalSort for several roots. Roots are visited from
+// last to first, so for a forest the first root and its subtree go first.
+func topologicalSortRoots(roots []*Cell) ([]*Cell, map[string]int) {
+	return topologicalSortMemo(roots, map[*Cell]*cellHashes{})
+}
+
+// topologicalSortMemo is topologicalSortRoots keeping cell hashes in memo for reuse
+// by the caller.
+func topologicalSortMemo(roots []*Cell, memo map[*Cell]*cellHashes) ([]*Cell, map[string]int) {
+	res := make([]*Cell, 0)
+	seen := map[string]bool{}
+	for i := len(roots) - 1; i >= 0; i-- {
+		topologicalSortImpl(roots[i], seen, memo, &res)
+	}
+
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
 	}
 
 	indexesMap := make(map[string]int)
 	for i := 0; i < len(res); i++ {
-		indexesMap[res[i].HashString()] = i
+		indexesMap[memoHashString(res[i], memo)] = i
 	}
 
-	return res, indexesMap, nil
+	return res, indexesMap
+}
+
+// FlattenBoc returns the cells of the boc SerializeBoc would build for root, in the
+// same order, and a map from cell hash to index in that order.
+func FlattenBoc(root *Cell) ([]*Cell, map[string]int, error) {
+	if root == nil {
+		return nil, nil, errors.New("root cell is nil")
+	}
+	cells, indexes := topologicalSort(root)
+	return cells, indexes, nil
 }
 
-func bocRepr(c *Cell, indexesMap map[string]int) []byte {
-	res := bocReprWithoutRefs(c)
+func bocRepr(c *Cell, levelMask int, refIndexes []int, sizeBytes int) []byte {
+	res := bocReprWithoutRefs(c, levelMask)
 
-	for _, ref := range c.Refs() {
-		res = append(res, byte(indexesMap[ref.HashString()]))
+	for _, idx := range refIndexes {
+		for i := sizeBytes - 1; i >= 0; i-- {
+			res = append(res, byte(idx>>(8*i)))
+		}
 	}
 
 	return res
 }
 
-func SerializeBoc(cell *Cell, idx bool, hasCrc32 bool, cacheBits bool, flags int) ([]byte, error) {
-	rootCell := cell
-	allCells, indexesMap, err := topologicalSort(rootCell)
-	if err != nil {
-		return nil, err
-	}
+// BocSerializeOptions are the header flags of a serialized boc.
+type BocSerializeOptions struct {
+	Idx       bool
+	HasCrc32  bool
+	CacheBits bool
+	Flags     int
+}
 
+type bocLayout struct {
+	sizeBytes   int
+	offsetBytes int
+	fullSize    int
+	endOffsets  []int
+}
+
+func computeBocLayout(allCells []*Cell, opts BocSerializeOptions) bocLayout {
 	cellsNum := len(allCells)
 	sBits := bits.Len(uint(cellsNum))
-	sBytes := int(math.Min(math.Ceil(float64(sBits)/8), 1))
+	sBytes := int(math.Max(math.Ceil(float64(sBits)/8), 1))
 	fullSize := 0
-	sizeIndex := make([]int, 0)
+	endOffsets := make([]int, 0)
 	for _, cell := range allCells {
-		sizeIndex = append(sizeIndex, fullSize)
-		fullSize = fullSize + len(bocRepr(cell, indexesMap))
+		fullSize = fullSize + 2 + (cell.BitSize()+7)/8 + cell.RefsSize()*sBytes
+		endOffsets = append(endOffsets, fullSize)
 	}
 
-	offsetBits := bits.Len(uint(fullSize))
+	// index entries with cache bits hold the offset shifted left by one bit
+	maxOffset := fullSize
+	if opts.CacheBits {
+		maxOffset = fullSize * 2
+	}
+	offsetBits := bits.Len(uint(maxOffset))
 	offsetBytes := int(math.Max(math.Ceil(float64(offsetBits)/8), 1))
 
-	serStr := NewBitString((1023 + 32*4 + 32*3) * cellsNum)
+	return bocLayout{
+		sizeBytes:   sBytes,
+		offsetBytes: offsetBytes,
+		fullSize:    fullSize,
+		endOffsets:  endOffsets,
+	}
+}
+
+// totalSize returns the length of the serialized boc in bytes.
+func (l bocLayout) totalSize(cellsNum int, rootsNum int, opts BocSerializeOptions) int {
+	size := len(reachBocMagicPrefix) + 1 + 1
+	size += 3*l.sizeBytes + l.offsetBytes
+	size += rootsNum * l.sizeBytes
+	if opts.Idx {
+		size += cellsNum * l.offsetBytes
+	}
+	size += l.fullSize
+	if opts.HasCrc32 {
+		size += 4
+	}
+	return size
+}
+
+// EstimateBocSize returns the exact length of the boc SerializeBoc would produce
+// for the cell with these options, without building it.
+func EstimateBocSize(cell *Cell, opts BocSerializeOptions) (int, error) {
+	memo := map[*Cell]*cellHashes{}
+	allCells, _ := topologicalSortMemo([]*Cell{cell}, memo)
+	// the only root goes first
+	err := checkSerializeBoc(allCells, []int{0}, opts, memo)
+	if err != nil {
+		return 0, err
+	}
+	layout := computeBocLayout(allCells, opts)
+	return layout.totalSize(len(allCells), 1, opts), nil
+}
+
+// ReserializeLike serializes the cell with the header flags of the boc it was
+// deserialized from, or with the ToBoc defaults for cells built in code.
+func ReserializeLike(cell *Cell) ([]byte, error) {
+	opts, ok := cell.BocOptions()
+	if !ok {
+		return cell.ToBoc()
+	}
+	return SerializeBoc(cell, opts.Idx, opts.HasCrc32, opts.CacheBits, opts.Flags)
+}
+
+func SerializeBoc(cell *Cell, idx bool, hasCrc32 bool, cacheBits bool, flags int) ([]byte, error) {
+	return SerializeBocMultiple([]*Cell{cell}, idx, hasCrc32, cacheBits, flags)
+}
+
+// SerializeBocMultiple serializes several roots into one boc. Roots are written in
+// the given order, so DeserializeBoc returns them in the same order.
+func SerializeBocMultiple(roots []*Cell, idx bool, hasCrc32 bool, cacheBits bool, flags int) ([]byte, error) {
+	if len(roots) == 0 {
+		return nil, errors.New("no root cells")
+	}
+	memo := map[*Cell]*cellHashes{}
+	allCells, indexesMap := topologicalSortMemo(roots, memo)
+
+	refIndexes := make([][]int, len(allCells))
+	for i, c := range allCells {
+		for _, ref := range c.Refs() {
+			refIndexes[i] = append(refIndexes[i], indexesMap[memoHashString(ref, memo)])
+		}
+	}
+
+	rootIndices := make([]int, len(roots))
+	for i, root := range roots {
+		rootIndices[i] = indexesMap[memoHashString(root, memo)]
+	}
+
+	opts := BocSerializeOptions{Idx: idx, HasCrc32: hasCrc32, CacheBits: cacheBits, Flags: flags}
+	return serializeBocCells(allCells, refIndexes, rootIndices, opts, memo)
+}
+
+// BocFromRoots serializes several roots with the given options, keeping their order.
+func BocFromRoots(roots []*Cell, opts BocSerializeOptions) ([]byte, error) {
+	return SerializeBocMultiple(roots, opts.Idx, opts.HasCrc32, opts.CacheBits, opts.Flags)
+}
+
+// BocFromRootsString works like BocFromRoots and returns the boc as hex.
+func BocFromRootsString(roots []*Cell, opts BocSerializeOptions) (string, error) {
+	boc, err := BocFromRoots(roots, opts)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(boc), nil
+}
+
+// BocFromRootsBase64 works like BocFromRoots and returns the boc as standard base64.
+func BocFromRootsBase64(roots []*Cell, opts BocSerializeOptions) (string, error) {
+	boc, err := BocFromRoots(roots, opts)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(boc), nil
+}
+
+// SerializeBocOrdered serializes cells in the given order without sorting or
+// deduplicating them. Every ref must be present in cells by pointer and go after
+// the cell referencing it.
+func SerializeBocOrdered(cells []*Cell, rootIndices []int, opts BocSerializeOptions) ([]byte, error) {
+	positions := make(map[*Cell]int, len(cells))
+	for i, c := range cells {
+		positions[c] = i
+	}
+
+	refIndexes := make([][]int, len(cells))
+	for i, c := range cells {
+		for _, ref := range c.Refs() {
+			r, ok := positions[ref]
+			if !ok {
+				return nil, errors.New("referenced cell is missing from the cells list")
+			}
+			if r <= i {
+				return nil, errors.New("cells are not in topological order")
+			}
+			refIndexes[i] = append(refIndexes[i], r)
+		}
+	}
+
+	for _, r := range rootIndices {
+		if r < 0 || r >= len(cells) {
+			return nil, errors.New("root index is out of range")
+		}
+	}
+
+	return serializeBocCells(cells, refIndexes, rootIndices, opts, map[*Cell]*cellHashes{})
+}
+
+// checkSerializeBoc checks that the cells can be serialized with opts.
+func checkSerializeBoc(allCells []*Cell, rootIndices []int, opts BocSerializeOptions, memo map[*Cell]*cellHashes) error {
+	if opts.CacheBits && !opts.Idx {
+		return errors.New("cache bits require an index")
+	}
+
+	// oversized cells would get descriptors no parser accepts
+	for i, cell := range allCells {
+		if cell.BitSize() > 1023 {
+			return fmt.Errorf("cell %v (%v) has %v bits, max is 1023", i, memoHashString(cell, memo), cell.BitSize())
+		}
+		if len(cell.refs) > 4 {
+			return fmt.Errorf("cell %v (%v) has %v refs, max is 4", i, memoHashString(cell, memo), len(cell.refs))
+		}
+	}
+
+	// roots are the deepest cells, and depths are hashed as 16 bits
+	for _, r := range rootIndices {
+		_, err := depth16(computeCellHashes(allCells[r], memo).depth(maxLevel))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serializeBocCells writes a boc with cells in the given order. refIndexes[i] holds
+// positions of the refs of cells[i]. memo keeps cell hashes and level masks and
+// may already hold some of the cells.
+func serializeBocCells(allCells []*Cell, refIndexes [][]int, rootIndices []int, opts BocSerializeOptions, memo map[*Cell]*cellHashes) ([]byte, error) {
+	err := checkSerializeBoc(allCells, rootIndices, opts, memo)
+	if err != nil {
+		return nil, err
+	}
+
+	cellsNum := len(allCells)
+	layout := computeBocLayout(allCells, opts)
+	sBytes := layout.sizeBytes
+	offsetBytes := layout.offsetBytes
+
+	serStr := NewBitString(layout.totalSize(cellsNum, len(rootIndices), opts) * 8)
 
 	serStr.WriteBytes(reachBocMagicPrefix)
-	serStr.WriteBitArray([]bool{idx, hasCrc32, cacheBits})
-	serStr.WriteUint(flags, 2)
+	serStr.WriteBitArray([]bool{opts.Idx, opts.HasCrc32, opts.CacheBits})
+	serStr.WriteUint(opts.Flags, 2)
 	serStr.WriteUint(sBytes, 3)
 	serStr.WriteUint(offsetBytes, 8)
 	serStr.WriteUint(cellsNum, sBytes*8)
-	serStr.WriteUint(1, sBytes*8)
-	serStr.WriteUint(0, sBytes*8)
-	serStr.WriteUint(fullSize, offsetBytes*8)
+	serStr.WriteUint(len(rootIndices), sBytes*8)
 	serStr.WriteUint(0, sBytes*8)
+	serStr.WriteUint(layout.fullSize, offsetBytes*8)
+	for _, r := range rootIndices {
+		serStr.WriteUint(r, sBytes*8)
+	}
 
-	if idx {
-		for i, _ := range allCells {
-			serStr.WriteUint(sizeIndex[i], offsetBytes*8)
+	// the index holds end offsets of the cells; with cache bits a cell is marked
+	// as worth caching when it is referenced more than once, roots included
+	if opts.Idx {
+		parents := make([]int, cellsNum)
+		for _, r := range rootIndices {
+			parents[r]++
+		}
+		for _, refs := range refIndexes {
+			for _, r := range refs {
+				parents[r]++
+			}
+		}
+		for i := range allCells {
+			entry := layout.endOffsets[i]
+			if opts.CacheBits {
+				entry *= 2
+				if parents[i] > 1 {
+					entry++
+				}
+			}
+			serStr.WriteUint(entry, offsetBytes*8)
 		}
 	}
 
-	for _, cell := range allCells {
-		serStr.WriteBytes(bocRepr(cell, indexesMap))
+	for i, cell := range allCells {
+		levelMask := computeCellHashes(cell, memo).levelMask
+		err := serStr.WriteBytes(bocRepr(cell, levelMask, refIndexes[i], sBytes))
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	resBytes, err := serStr.GetTopUppedArray()
@@ -399,9 +1042,9 @@ func SerializeBoc(cell *Cell, idx bool, hasCrc32 bool, cacheBits bool, flags int
 		return nil, err
 	}
 
-	if hasCrc32 {
+	if opts.HasCrc32 {
 		checksum := make([]byte, 4)
-		binary.LittleEndian.PutUint32(checksum, crc32.Checksum(resBytes, crc32.MakeTable(crc32.Castagnoli)))
+		binary.LittleEndian.PutUint32(checksum, crc32.Checksum(resBytes, crcTable))
 
 		resBytes = append(resBytes, checksum...)
 	}
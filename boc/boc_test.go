@@ -1,8 +1,15 @@
 package boc
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
+	"strings"
 	"testing"
 )
 
@@ -64,3 +71,1180 @@ func TestKek2(t *testing.T) {
 
 	//fmt.Println(parse.ReadBigUint(8))
 }
+
+func TestDeserializeBocAbsentCells(t *testing.T) {
+	// one cell, one root and one absent cell, no index and no crc32c
+	s := "b5ee9c7201010101010300000280"
+
+	data, _ := hex.DecodeString(s)
+
+	_, err := DeserializeBoc(data)
+	if err == nil {
+		t.Fatal("expected error for boc with absent cells")
+	}
+	if !strings.Contains(err.Error(), "absent") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func wideTree() *Cell {
+	root := NewCell()
+	root.Bits.WriteUint(0xabc, 12)
+	for i := 0; i < 4; i++ {
+		c := NewCell()
+		c.Bits.WriteUint(i, 7)
+		for j := 0; j < 4; j++ {
+			l := NewCell()
+			l.Bits.WriteUint(i*4+j, 32)
+			c.AddReference(l)
+		}
+		root.AddReference(c)
+	}
+	return root
+}
+
+func TestCellHash(t *testing.T) {
+	if NewCell().HashString() != "96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7" {
+		t.Fatal("invalid empty cell hash")
+	}
+	if wideTree().HashString() != "266af4927bf8185374dc55725dad260b7829f899d4e9e8bd748d577a8e5af13b" {
+		t.Fatal("invalid wide tree hash")
+	}
+}
+
+func TestCellStats(t *testing.T) {
+	newLeaf := func() *Cell {
+		leaf := NewCell()
+		leaf.Bits.WriteUint(0xff, 8)
+		return leaf
+	}
+
+	a := NewCell()
+	a.Bits.WriteUint(1, 3)
+	a.AddReference(newLeaf())
+	b := NewCell()
+	b.Bits.WriteUint(2, 5)
+	b.AddReference(newLeaf())
+	root := NewCell()
+	root.AddReference(a)
+	root.AddReference(b)
+
+	cells, bits, refs := root.Stats()
+	if cells != 4 || bits != 3+5+8 || refs != 4 {
+		t.Fatalf("invalid stats: %v cells, %v bits, %v refs", cells, bits, refs)
+	}
+
+	data, err := root.ToBoc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := parseBocHeader(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(header.cellsNum) != cells {
+		t.Fatalf("boc has %v cells, stats report %v", header.cellsNum, cells)
+	}
+
+	parsed, err := DeserializeBoc(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed[0].HashString() != root.HashString() {
+		t.Fatal("invalid root hash after round-trip")
+	}
+}
+
+func TestEstimateBocSize(t *testing.T) {
+	single := NewCell()
+	single.Bits.WriteUint(0xdeadbeef, 32)
+
+	trees := []*Cell{NewCell(), single, wideTree()}
+	options := []BocSerializeOptions{
+		{},
+		{Idx: true},
+		{HasCrc32: true},
+		{Idx: true, HasCrc32: true},
+	}
+
+	for i, tree := range trees {
+		for _, opts := range options {
+			data, err := SerializeBoc(tree, opts.Idx, opts.HasCrc32, opts.CacheBits, opts.Flags)
+			if err != nil {
+				t.Fatal(err)
+			}
+			size, err := EstimateBocSize(tree, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size != len(data) {
+				t.Fatalf("tree %v, options %+v: estimated %v bytes, got %v", i, opts, size, len(data))
+			}
+		}
+	}
+
+	_, err := EstimateBocSize(single, BocSerializeOptions{CacheBits: true})
+	if err == nil {
+		t.Fatal("options rejected by SerializeBoc must be rejected")
+	}
+}
+
+func TestSerializeBocOrdered(t *testing.T) {
+	root := wideTree()
+	cells, _ := topologicalSort(root)
+
+	opts := BocSerializeOptions{Idx: true, HasCrc32: true}
+	ordered, err := SerializeBocOrdered(cells, []int{0}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sorted, err := SerializeBoc(root, opts.Idx, opts.HasCrc32, opts.CacheBits, opts.Flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(ordered) != hex.EncodeToString(sorted) {
+		t.Fatal("ordered serialization differs from sorted one")
+	}
+
+	cells[0], cells[1] = cells[1], cells[0]
+	_, err = SerializeBocOrdered(cells, []int{1}, opts)
+	if err == nil {
+		t.Fatal("expected topological order error")
+	}
+
+	_, err = SerializeBocOrdered(cells[:1], []int{0}, opts)
+	if err == nil {
+		t.Fatal("expected missing ref error")
+	}
+}
+
+func BenchmarkSerializeBocSorted(b *testing.B) {
+	root := wideTree()
+	for i := 0; i < b.N; i++ {
+		SerializeBoc(root, true, true, false, 0)
+	}
+}
+
+func BenchmarkSerializeBocOrdered(b *testing.B) {
+	root := wideTree()
+	cells, _ := topologicalSort(root)
+	opts := BocSerializeOptions{Idx: true, HasCrc32: true}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		SerializeBocOrdered(cells, []int{0}, opts)
+	}
+}
+
+func TestDeserializeBocContextCancelled(t *testing.T) {
+	data, err := wideTree().ToBoc()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cells, err := DeserializeBocContext(context.Background(), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cells[0].HashString() != wideTree().HashString() {
+		t.Fatal("invalid root hash")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = DeserializeBocContext(ctx, data)
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+// countingCtx is a context that is done after its Err was called failAfter times.
+type countingCtx struct {
+	context.Context
+	calls     int
+	failAfter int
+}
+
+func (c *countingCtx) Err() error {
+	c.calls++
+	if c.calls > c.failAfter {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestDeserializeBocContextCancelledMidway(t *testing.T) {
+	// after the check on entry, 3000 cells get checked at cells 0, 1024 and 2048
+	// while reading and again while linking, so every failAfter below stops at
+	// a different place inside the loops
+	data, err := shallowTree(3000).ToBoc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, failAfter := range []int{1, 2, 3, 4, 5, 6} {
+		ctx := &countingCtx{Context: context.Background(), failAfter: failAfter}
+		_, err = DeserializeBocContext(ctx, data)
+		if err != context.Canceled {
+			t.Fatalf("fail after %v: expected context.Canceled, got %v", failAfter, err)
+		}
+		if ctx.calls != failAfter+1 {
+			t.Fatalf("fail after %v: deserialization must stop at the first failing check, got %v calls", failAfter, ctx.calls)
+		}
+	}
+
+	ctx := &countingCtx{Context: context.Background(), failAfter: 7}
+	_, err = DeserializeBocContext(ctx, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReserializeLike(t *testing.T) {
+	root := wideTree()
+	for _, opts := range []BocSerializeOptions{{}, {Idx: true}, {HasCrc32: true}} {
+		data, err := SerializeBoc(root, opts.Idx, opts.HasCrc32, opts.CacheBits, opts.Flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cells, err := DeserializeBoc(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsedOpts, ok := cells[0].BocOptions()
+		if !ok || parsedOpts != opts {
+			t.Fatalf("expected options %+v, got %+v", opts, parsedOpts)
+		}
+		res, err := ReserializeLike(cells[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(res) != hex.EncodeToString(data) {
+			t.Fatalf("options %+v are not preserved", opts)
+		}
+	}
+
+	if _, ok := root.BocOptions(); ok {
+		t.Fatal("cells built in code have no boc options")
+	}
+}
+
+func TestSerializeBocCacheBits(t *testing.T) {
+	leaf := NewCell()
+	leaf.Bits.WriteUint(0xff, 8)
+	a := NewCell()
+	a.Bits.WriteUint(1, 8)
+	a.AddReference(leaf)
+	root := NewCell()
+	root.AddReference(a)
+	root.AddReference(leaf)
+
+	_, err := SerializeBoc(root, false, false, true, 0)
+	if err == nil {
+		t.Fatal("cache bits without index must be rejected")
+	}
+
+	data, err := SerializeBoc(root, true, true, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := parseBocHeader(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !header.hasCacheBits || header.cellsNum != 3 {
+		t.Fatal("invalid header")
+	}
+	if header.index[len(header.index)-1] != header.totCellsSize {
+		t.Fatalf("index must hold end offsets: %v", header.index)
+	}
+
+	// magic, flags, offset size, 3 counters, total size and one root, all 1 byte wide
+	rawIndex := data[4+1+1+3+1+1:][:3]
+	if rawIndex[0]&1 != 0 || rawIndex[1]&1 != 0 || rawIndex[2]&1 != 1 {
+		t.Fatalf("only the shared leaf must have the cache bit: %x", rawIndex)
+	}
+
+	cells, err := DeserializeBoc(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cells[0].HashString() != root.HashString() {
+		t.Fatal("invalid root hash after round-trip")
+	}
+}
+
+func TestDeserializeBocBrokenTopology(t *testing.T) {
+	// two cells, the second one references the first
+	data, _ := hex.DecodeString("b5ee9c7201010201000500" + "0000" + "010000")
+	_, err := DeserializeBoc(data)
+	if !errors.Is(err, ErrBrokenTopology) {
+		t.Fatalf("expected ErrBrokenTopology, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "cell 1 ref 0 points to cell 0") {
+		t.Fatalf("missing indices in %q", err)
+	}
+}
+
+func TestDeserializeLeanBoc(t *testing.T) {
+	// An empty root with one ref to a cell holding 0xab, in both lean formats:
+	// without crc32c and with it.
+	vectors := []string{
+		"68ff65f301010201000603060100010002ab",
+		"acc3a72801010201000603060100010002abcc51d97c",
+	}
+	for _, v := range vectors {
+		data, _ := hex.DecodeString(v)
+		cells, err := DeserializeBoc(data)
+		if err != nil {
+			t.Fatalf("%v: %v", v, err)
+		}
+		if len(cells) != 1 || len(cells[0].Refs()) != 1 {
+			t.Fatalf("%v: invalid tree", v)
+		}
+		if cells[0].Refs()[0].Bits.ToFiftHex() != "AB" {
+			t.Fatalf("%v: invalid child data", v)
+		}
+	}
+
+	data, _ := hex.DecodeString(vectors[1])
+	data[len(data)-5] ^= 1
+	_, err := DeserializeBoc(data)
+	if err == nil {
+		t.Fatal("crc mismatch must be detected")
+	}
+}
+
+func TestDeserializeBocBase64URL(t *testing.T) {
+	c := NewCell()
+	c.Bits.WriteBytes([]byte{0xfb, 0xef, 0xff, 0xfb, 0xef, 0xff})
+	data, err := c.ToBoc()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, enc := range []*base64.Encoding{base64.URLEncoding, base64.RawURLEncoding} {
+		s := enc.EncodeToString(data)
+		if !strings.ContainsAny(s, "-_") {
+			t.Fatalf("test boc must use url-safe characters: %v", s)
+		}
+		cells, err := DeserializeBocBase64URL(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cells[0].HashString() != c.HashString() {
+			t.Fatal("invalid cell after decoding")
+		}
+	}
+}
+
+func TestSerializeBocOversizedCell(t *testing.T) {
+	oversized := NewCell()
+	oversized.Bits = NewBitString(1100)
+	oversized.Bits.WriteUint(0, 1024)
+	root := NewCell()
+	root.AddReference(oversized)
+
+	_, err := root.ToBoc()
+	if err == nil || !strings.Contains(err.Error(), "cell 1") || !strings.Contains(err.Error(), "1024 bits") {
+		t.Fatalf("expected an error naming the oversized cell, got %v", err)
+	}
+
+	many := NewCell()
+	for i := 0; i < 5; i++ {
+		many.refs = append(many.refs, NewCell())
+	}
+	_, err = many.ToBoc()
+	if err == nil || !strings.Contains(err.Error(), "5 refs") {
+		t.Fatalf("expected too many refs error, got %v", err)
+	}
+}
+
+func TestSerializeBocMultipleRootOrder(t *testing.T) {
+	roots := make([]*Cell, 3)
+	for i := range roots {
+		roots[i] = NewCell()
+		roots[i].Bits.WriteUint(i+1, 8)
+	}
+	// the last root references the first one, so it has to be written before it
+	roots[2].AddReference(roots[0])
+
+	data, err := SerializeBocMultiple(roots, true, true, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cells, err := DeserializeBoc(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != len(roots) {
+		t.Fatalf("expected %v roots, got %v", len(roots), len(cells))
+	}
+	for i := range roots {
+		if cells[i].HashString() != roots[i].HashString() {
+			t.Fatalf("root %v is out of order", i)
+		}
+	}
+}
+
+func TestFlattenBoc(t *testing.T) {
+	root := wideTree()
+	cells, indexes, err := FlattenBoc(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cells[0] != root || indexes[root.HashString()] != 0 {
+		t.Fatal("root must go first")
+	}
+	for i, c := range cells {
+		if indexes[c.HashString()] != i {
+			t.Fatalf("invalid index of cell %v", i)
+		}
+		for _, ref := range c.Refs() {
+			if indexes[ref.HashString()] <= i {
+				t.Fatalf("cell %v goes after its ref", i)
+			}
+		}
+	}
+
+	data, err := SerializeBoc(root, false, false, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := parseBocHeader(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(header.cellsNum) != len(cells) {
+		t.Fatalf("serialized %v cells, flattened %v", header.cellsNum, len(cells))
+	}
+
+	_, _, err = FlattenBoc(nil)
+	if err == nil {
+		t.Fatal("nil root must be rejected")
+	}
+}
+
+func TestDeserializeBocPrefix(t *testing.T) {
+	root := wideTree()
+	for _, crc := range []bool{false, true} {
+		data, err := SerializeBoc(root, true, crc, false, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		withTrailer := append(append([]byte{}, data...), 0xde, 0xad)
+
+		_, err = DeserializeBoc(withTrailer)
+		if err == nil {
+			t.Fatal("DeserializeBoc must reject trailing bytes")
+		}
+		cells, n, err := DeserializeBocPrefix(withTrailer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(data) {
+			t.Fatalf("consumed %v bytes, boc has %v", n, len(data))
+		}
+		if cells[0].HashString() != root.HashString() {
+			t.Fatal("invalid root")
+		}
+	}
+}
+
+func TestEmptyCellRoundTrip(t *testing.T) {
+	empty := NewCell()
+	if !bytes.Equal(bocReprWithoutRefs(empty, 0), []byte{0, 0}) {
+		t.Fatalf("invalid empty cell descriptors %x", bocReprWithoutRefs(empty, 0))
+	}
+	for _, idx := range []bool{false, true} {
+		data, err := SerializeBoc(empty, idx, true, false, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cells, err := DeserializeBoc(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cells[0].BitSize() != 0 || cells[0].RefsSize() != 0 {
+			t.Fatal("empty cell must stay empty")
+		}
+		if cells[0].HashString() != empty.HashString() {
+			t.Fatal("invalid empty cell hash")
+		}
+	}
+
+	// garbage after the cursor must not leak into the serialized data
+	dirty := NewCell()
+	dirty.Bits.WriteUint(0xff, 8)
+	dirty.Bits.cursor = 3
+	if !bytes.Equal(bocReprWithoutRefs(dirty, 0), []byte{0, 1, 0xf0}) {
+		t.Fatalf("invalid partial byte %x", bocReprWithoutRefs(dirty, 0))
+	}
+}
+
+// constantHash makes every cell hash equal, so every cell is a duplicate of the root.
+type constantHash struct {
+	hash.Hash
+}
+
+func (constantHash) Sum(b []byte) []byte {
+	return append(b, make([]byte, 32)...)
+}
+
+func TestCellHasherHook(t *testing.T) {
+	defer func(h func() hash.Hash) { newCellHasher = h }(newCellHasher)
+
+	root := wideTree()
+	cells, _, err := FlattenBoc(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) < 2 {
+		t.Fatal("test tree must have several cells")
+	}
+
+	newCellHasher = func() hash.Hash { return constantHash{sha256.New()} }
+	cells, _, err = FlattenBoc(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != 1 || cells[0] != root {
+		t.Fatalf("cells with equal hashes must be deduplicated, got %v cells", len(cells))
+	}
+}
+
+func TestSerializeBocMultipleSharedCells(t *testing.T) {
+	code := NewCell()
+	code.Bits.WriteBytes([]byte("shared contract code"))
+	// equal by hash but a different pointer
+	codeCopy := NewCell()
+	codeCopy.Bits.WriteBytes([]byte("shared contract code"))
+
+	a := NewCell()
+	a.Bits.WriteUint(1, 8)
+	a.AddReference(code)
+	b := NewCell()
+	b.Bits.WriteUint(2, 8)
+	b.AddReference(codeCopy)
+
+	data, err := SerializeBocMultiple([]*Cell{a, b}, false, false, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := parseBocHeader(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.cellsNum != 3 {
+		t.Fatalf("shared code cell must be stored once, got %v cells", header.cellsNum)
+	}
+	if bytes.Count(data, []byte("shared contract code")) != 1 {
+		t.Fatal("shared code data must be stored once")
+	}
+
+	cells, err := DeserializeBoc(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cells[0].HashString() != a.HashString() || cells[1].HashString() != b.HashString() {
+		t.Fatal("invalid roots")
+	}
+	if cells[0].Refs()[0] != cells[1].Refs()[0] {
+		t.Fatal("roots must share the deserialized code cell")
+	}
+}
+
+func hashCellReprArgs(c *Cell) ([]byte, int, [][]byte, []uint16) {
+	hashes := make([][]byte, 0, c.RefsSize())
+	depths := make([]uint16, 0, c.RefsSize())
+	for _, ref := range c.Refs() {
+		hashes = append(hashes, ref.Hash())
+		d, _ := ref.Depth16()
+		depths = append(depths, d)
+	}
+	data, bitLen := c.DataBytes()
+	return data, bitLen, hashes, depths
+}
+
+func TestHashCellRepr(t *testing.T) {
+	root := wideTree()
+	cells, _, _ := FlattenBoc(root)
+	for i, c := range cells {
+		data, bitLen, hashes, depths := hashCellReprArgs(c)
+		hash, err := HashCellRepr(data, bitLen, hashes, depths)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(hash, c.Hash()) {
+			t.Fatalf("hash of cell %v differs", i)
+		}
+	}
+
+	_, err := HashCellRepr([]byte{0}, 9, nil, nil)
+	if err == nil {
+		t.Fatal("bit length beyond data must be rejected")
+	}
+	_, err = HashCellRepr(nil, 0, [][]byte{make([]byte, 32)}, nil)
+	if err == nil {
+		t.Fatal("refs without depths must be rejected")
+	}
+}
+
+// BenchmarkCellHashWideTree hashes the same cell as BenchmarkHashCellRepr, but
+// through Cell.Hash, which also hashes all refs.
+func BenchmarkCellHashWideTree(b *testing.B) {
+	b.ReportAllocs()
+	root := wideTree()
+	for i := 0; i < b.N; i++ {
+		root.Hash()
+	}
+}
+
+func BenchmarkHashCellRepr(b *testing.B) {
+	c := wideTree()
+	data, bitLen, hashes, depths := hashCellReprArgs(c)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		HashCellRepr(data, bitLen, hashes, depths)
+	}
+}
+
+func TestBocEqual(t *testing.T) {
+	child := NewCell()
+	child.Bits.WriteUint(7, 3)
+	root := NewCell()
+	root.Bits.WriteUint(0xdead, 16)
+	root.AddReference(child)
+
+	compact, err := root.ToBocCompact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := root.ToBocCustom(true, true, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(compact, full) {
+		t.Fatal("encodings must differ")
+	}
+	eq, err := BocEqual(compact, full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !eq {
+		t.Fatal("same tree must be equal")
+	}
+
+	other, err := child.ToBoc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq, err = BocEqual(compact, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eq {
+		t.Fatal("different trees must not be equal")
+	}
+
+	_, err = BocEqual(compact, full[:len(full)-1])
+	if err == nil {
+		t.Fatal("broken boc must fail")
+	}
+}
+
+func TestDeserializeCellDataBounds(t *testing.T) {
+	cases := []struct {
+		name  string
+		data  []byte
+		field string
+	}{
+		{"descriptors", []byte{0x01}, "descriptors"},
+		{"refs count", []byte{0x05, 0x00, 1, 2, 3, 4, 5}, "refs count"},
+		{"data", []byte{0x00, 0xff, 0x01, 0x02}, "cell data"},
+		{"ref", []byte{0x02, 0x02, 0xab, 0x01}, "cell ref 1"},
+		{"wide ref", []byte{0x01, 0x00, 0x01}, "cell ref 0"},
+	}
+	for _, c := range cases {
+		refSize := 1
+		if c.name == "wide ref" {
+			refSize = 2
+		}
+		_, _, _, err := deserializeCellData(c.data, refSize)
+		if err == nil {
+			t.Fatalf("%v: expected error", c.name)
+		}
+		if !strings.Contains(err.Error(), c.field) {
+			t.Fatalf("%v: error %q doesn't name %q", c.name, err, c.field)
+		}
+	}
+
+	cell, refs, rest, err := deserializeCellData([]byte{0x02, 0x02, 0xab, 0x01, 0x02, 0xff}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cell.BitSize() != 8 || len(refs) != 2 || refs[1] != 2 || len(rest) != 1 {
+		t.Fatal("invalid cell")
+	}
+}
+
+func TestBocFlagsRoundTrip(t *testing.T) {
+	root := wideTree()
+	for flags := 0; flags < 4; flags++ {
+		data, err := SerializeBoc(root, true, true, false, flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, err := parseBocHeader(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.flags != flags {
+			t.Fatalf("serialized flags %v, parsed %v", flags, header.flags)
+		}
+
+		cells, err := DeserializeBoc(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := ReserializeLike(cells[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, again) {
+			t.Fatalf("flags %v: boc doesn't round-trip", flags)
+		}
+	}
+}
+
+func TestDeserializeBocOrdered(t *testing.T) {
+	a := NewCell()
+	a.Bits.WriteUint(1, 8)
+	b := NewCell()
+	b.Bits.WriteUint(2, 8)
+	root := NewCell()
+	root.AddReference(a)
+	root.AddReference(b)
+
+	opts := BocSerializeOptions{HasCrc32: true}
+	data, err := SerializeBocOrdered([]*Cell{root, b, a}, []int{0}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cells, rootIndices, err := DeserializeBocOrdered(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != 3 || len(rootIndices) != 1 || rootIndices[0] != 0 {
+		t.Fatal("invalid cells or roots")
+	}
+	if cells[1].HashString() != b.HashString() || cells[2].HashString() != a.HashString() {
+		t.Fatal("cells must keep the boc order")
+	}
+	again, err := SerializeBocOrdered(cells, rootIndices, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, again) {
+		t.Fatal("boc must be byte-identical after re-encoding")
+	}
+}
+
+func TestDeserializeBocErrorOffsets(t *testing.T) {
+	root := wideTree()
+	data, err := SerializeBoc(root, false, false, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := parseBocHeader(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = DeserializeBoc(data[:len(data)-1])
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("cells data at offset %v", header.cellsOffset)) {
+		t.Fatalf("truncated boc error must name the offset, got %v", err)
+	}
+
+	// the last cell claims more data bytes than the boc has
+	cells, _ := topologicalSort(root)
+	broken := append([]byte{}, data...)
+	last := len(data) - len(bocRepr(cells[len(cells)-1], 0, nil, 0))
+	broken[last+1] = 0x7f
+	_, err = DeserializeBoc(broken)
+	want := fmt.Sprintf("at offset %v (cell %v)", last, len(cells)-1)
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Fatalf("expected error with %q, got %v", want, err)
+	}
+
+	_, err = DeserializeBoc(append(data, 0))
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("offset %v", len(data))) {
+		t.Fatalf("trailing bytes error must name the offset, got %v", err)
+	}
+}
+
+func TestRootCount(t *testing.T) {
+	a := NewCell()
+	a.Bits.WriteUint(1, 8)
+	b := NewCell()
+	b.Bits.WriteUint(0xabc, 12)
+	b.AddReference(a)
+	multi, err := SerializeBocMultiple([]*Cell{a, b}, true, true, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	single, err := b.ToBocCompact()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for want, data := range map[int][]byte{1: single, 2: multi} {
+		n, err := RootCount(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want || !IsValidBoc(data) {
+			t.Fatalf("expected %v roots, got %v", want, n)
+		}
+	}
+
+	selfRef, _ := hex.DecodeString("b5ee9c72010102010005000100000000")
+	badCompletion := append([]byte{}, single...)
+	// cells are 01 03 ab c8 01 and 00 02 01, drop the completion bit of 0xc8
+	badCompletion[len(single)-5] = 0x00
+	invalid := map[string][]byte{
+		"self ref":       selfRef,
+		"bad completion": badCompletion,
+		"truncated":      single[:len(single)-1],
+		"empty":          nil,
+	}
+	for name, data := range invalid {
+		if IsValidBoc(data) {
+			t.Fatalf("%v: boc must be invalid", name)
+		}
+		_, err := DeserializeBoc(data)
+		if err == nil {
+			t.Fatalf("%v: DeserializeBoc must reject the boc too", name)
+		}
+	}
+}
+
+func TestMalformedBocHeader(t *testing.T) {
+	// each of these used to panic while reading the header
+	invalid := map[string]string{
+		"offset size 0":        "b5ee9c7201ff010100000000",
+		"offset size 168":      "b5ee9c7201a815010084000403abc801060b10040101020304050008000000000008000000010008000000020008000000030401030708090a000800000004000800000005000800000031",
+		"offset size 140":      "b5ee9c72e18c1501000084000010001efe2a00360042004e005c006800740080008c009a00a600b200be00ca00",
+		"offset size 96":       "b5ee9c72016015010084000403abc801060b10040101020304050008000000000008000000010008000000020008",
+		"ref size 0":           "b5ee9c7200010101000000",
+		"ref size 7":           "b5ee9c7207010101000000",
+		"lean ref size 9":      "68ff65f309010101000000",
+		"short counters":       "b5ee9c72010201",
+		"cells over data size": "b5ee9c720101ff0100020000",
+	}
+	for name, v := range invalid {
+		data, _ := hex.DecodeString(v)
+		if IsValidBoc(data) {
+			t.Fatalf("%v: boc must be invalid", name)
+		}
+		_, err := DeserializeBoc(data)
+		if err == nil {
+			t.Fatalf("%v: DeserializeBoc must reject the boc too", name)
+		}
+	}
+}
+
+func TestDeserializeBocCacheBits(t *testing.T) {
+	shared := NewCell()
+	shared.Bits.WriteUint(7, 8)
+	left := NewCell()
+	left.Bits.WriteUint(1, 8)
+	left.AddReference(shared)
+	root := NewCell()
+	root.AddReference(left)
+	root.AddReference(shared)
+
+	data, err := SerializeBoc(root, true, false, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := parseBocHeader(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header.cacheBits) != 3 || header.cacheBits[0] || header.cacheBits[1] || !header.cacheBits[2] {
+		t.Fatalf("only the shared cell must be cached, got %v", header.cacheBits)
+	}
+	if !IsValidBoc(data) {
+		t.Fatal("consistent cache bits must be accepted")
+	}
+
+	// one byte index entries go right before the cells; mark the root as cached
+	broken := append([]byte{}, data...)
+	broken[header.cellsOffset-3] |= 1
+	_, err = DeserializeBoc(broken)
+	if err == nil || !strings.Contains(err.Error(), "cache bit") {
+		t.Fatalf("inconsistent cache bit must be rejected, got %v", err)
+	}
+	if IsValidBoc(broken) {
+		t.Fatal("IsValidBoc must reject inconsistent cache bits")
+	}
+}
+
+func TestCacheBitsRootReferenced(t *testing.T) {
+	child := NewCell()
+	child.Bits.WriteUint(2, 8)
+	root := NewCell()
+	root.Bits.WriteUint(1, 8)
+	root.AddReference(child)
+
+	// the child is a root and a ref of the other root, so it has two parents
+	data, err := SerializeBocMultiple([]*Cell{root, child}, true, false, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := parseBocHeader(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header.cacheBits) != 2 || header.cacheBits[0] || !header.cacheBits[1] {
+		t.Fatalf("only the referenced root must be cached, got %v", header.cacheBits)
+	}
+	roots, err := DeserializeBoc(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 2 || !bytes.Equal(roots[1].Hash(), child.Hash()) {
+		t.Fatal("invalid roots after round-trip")
+	}
+	if !IsValidBoc(data) {
+		t.Fatal("IsValidBoc must count root list entries as parents")
+	}
+}
+
+func TestBocFromRoots(t *testing.T) {
+	roots := make([]*Cell, 3)
+	for i := range roots {
+		roots[i] = NewCell()
+		roots[i].Bits.WriteUint(3-i, 8)
+	}
+	// the last root is also a ref of the first one
+	roots[0].AddReference(roots[2])
+
+	opts := BocSerializeOptions{Idx: true, HasCrc32: true}
+	data, err := BocFromRoots(roots, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hexStr, err := BocFromRootsString(roots, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64, err := BocFromRootsBase64(roots, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hexStr != hex.EncodeToString(data) || b64 != base64.StdEncoding.EncodeToString(data) {
+		t.Fatal("string variants must encode the same boc")
+	}
+
+	parsed, err := DeserializeBoc(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != len(roots) {
+		t.Fatalf("expected %v roots, got %v", len(roots), len(parsed))
+	}
+	for i := range roots {
+		if parsed[i].HashString() != roots[i].HashString() {
+			t.Fatalf("root %v is out of order", i)
+		}
+	}
+
+	_, err = BocFromRoots(nil, opts)
+	if err == nil {
+		t.Fatal("no roots must fail")
+	}
+}
+
+// shallowTree returns a tree of n distinct cells, each with up to 4 children.
+func shallowTree(n int) *Cell {
+	cells := make([]*Cell, n)
+	for i := range cells {
+		cells[i] = NewCell()
+		cells[i].Bits.WriteUint(i, 16)
+		if i > 0 {
+			cells[(i-1)/4].AddReference(cells[i])
+		}
+	}
+	return cells[0]
+}
+
+func TestSerializeBocSharedChain(t *testing.T) {
+	// every cell refers to the previous one twice, so the tree has 2^30 paths
+	c := NewCell()
+	for i := 0; i < 30; i++ {
+		parent := NewCell()
+		parent.Bits.WriteUint(i, 8)
+		parent.AddReference(c)
+		parent.AddReference(c)
+		c = parent
+	}
+	if c.LevelMask() != 0 {
+		t.Fatal("ordinary tree must have level 0")
+	}
+	data, err := c.ToBoc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cells, err := DeserializeBoc(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cells[0].Hash(), c.Hash()) {
+		t.Fatal("invalid root after round-trip")
+	}
+}
+
+func TestSerializeBocManyCells(t *testing.T) {
+	root := shallowTree(1000)
+
+	data, err := root.ToBoc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := parseBocHeader(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.sizeBytes != 2 || header.cellsNum != 1000 {
+		t.Fatalf("expected 1000 cells with 2 byte refs, got %v cells with %v byte refs", header.cellsNum, header.sizeBytes)
+	}
+
+	parsed, err := DeserializeBoc(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed[0].HashString() != root.HashString() {
+		t.Fatal("root hash changed after round-trip")
+	}
+	count, _, _ := parsed[0].Stats()
+	if count != 1000 {
+		t.Fatalf("expected 1000 cells, got %v", count)
+	}
+}
+
+func TestBocFieldWidths(t *testing.T) {
+	cases := []struct {
+		cells     int
+		sizeBytes int
+	}{
+		{1, 1}, {255, 1}, {256, 2}, {70000, 3},
+	}
+	for _, c := range cases {
+		cells := make([]*Cell, c.cells)
+		for i := range cells {
+			cells[i] = NewCell()
+			cells[i].Bits.WriteUint(i, 24)
+			if i > 0 {
+				cells[(i-1)/4].AddReference(cells[i])
+			}
+		}
+		root := cells[0]
+		opts := BocSerializeOptions{Idx: true, HasCrc32: true, CacheBits: true}
+
+		sorted, _ := topologicalSort(root)
+		layout := computeBocLayout(sorted, opts)
+		if layout.sizeBytes != c.sizeBytes {
+			t.Fatalf("%v cells: expected %v size bytes, got %v", c.cells, c.sizeBytes, layout.sizeBytes)
+		}
+
+		data, err := BocFromRoots([]*Cell{root}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, err := parseBocHeader(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.sizeBytes != layout.sizeBytes || int(data[5]) != layout.offsetBytes {
+			t.Fatalf("%v cells: header widths don't match the layout", c.cells)
+		}
+		if int(header.cellsNum) != c.cells || header.rootsNum != 1 || header.rootList[0] != 0 {
+			t.Fatalf("%v cells: invalid counters", c.cells)
+		}
+		if int(header.totCellsSize) != layout.fullSize || len(header.index) != c.cells {
+			t.Fatalf("%v cells: invalid cells size or index", c.cells)
+		}
+		for i, offset := range header.index {
+			if int(offset) != layout.endOffsets[i] {
+				t.Fatalf("%v cells: index entry %v is %v, expected %v", c.cells, i, offset, layout.endOffsets[i])
+			}
+		}
+
+		parsed, err := DeserializeBoc(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed[0].HashString() != root.HashString() {
+			t.Fatalf("%v cells: root hash changed after round-trip", c.cells)
+		}
+	}
+}
+
+func TestDeserializeBocForEach(t *testing.T) {
+	root := wideTree()
+	data, err := root.ToBoc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cells, _, err := DeserializeBocOrdered(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := 0
+	err = DeserializeBocForEach(data, func(index int, c *Cell, refs []int) error {
+		if index != seen {
+			t.Fatalf("expected cell %v, got %v", seen, index)
+		}
+		seen++
+		if c.RefsSize() != 0 {
+			t.Fatal("cells must be passed without refs")
+		}
+		if c.Bits.ToFiftHex() != cells[index].Bits.ToFiftHex() {
+			t.Fatalf("cell %v has invalid data", index)
+		}
+		if len(refs) != cells[index].RefsSize() {
+			t.Fatalf("cell %v has %v ref indexes, expected %v", index, len(refs), cells[index].RefsSize())
+		}
+		for i, r := range refs {
+			if cells[r] != cells[index].Refs()[i] {
+				t.Fatalf("cell %v ref %v must point to cell %v", index, i, r)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen != len(cells) {
+		t.Fatalf("expected %v cells, got %v", len(cells), seen)
+	}
+
+	errStop := errors.New("stop")
+	calls := 0
+	err = DeserializeBocForEach(data, func(index int, c *Cell, refs []int) error {
+		calls++
+		return errStop
+	})
+	if err != errStop || calls != 1 {
+		t.Fatal("error from fn must stop the iteration")
+	}
+
+	err = DeserializeBocForEach(data[:len(data)-1], func(index int, c *Cell, refs []int) error {
+		t.Fatal("fn must not be called for a broken boc")
+		return nil
+	})
+	if err == nil {
+		t.Fatal("broken boc must fail")
+	}
+}
@@ -4,18 +4,20 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
+	"fmt"
 )
 
 type Cell struct {
-	Bits     BitString
-	isExotic bool
-	refs     []*Cell
+	Bits       BitString
+	isExotic   bool
+	refs       []*Cell
+	bocOptions *BocSerializeOptions
 }
 
 func NewCell() *Cell {
 	return &Cell{
 		Bits:     NewBitString(1023),
-		refs:     make([]*Cell, 4),
+		refs:     make([]*Cell, 0, 4),
 		isExotic: false,
 	}
 }
@@ -23,50 +25,301 @@ func NewCell() *Cell {
 func NewCellExotic() *Cell {
 	return &Cell{
 		Bits:     NewBitString(1023),
-		refs:     make([]*Cell, 4),
+		refs:     make([]*Cell, 0, 4),
 		isExotic: true,
 	}
 }
 
+// BytesToCell creates a cell holding data. Data longer than 127 bytes does not fit
+// in one cell; WriteBinary continues it in a chain of refs.
+func BytesToCell(data []byte) (*Cell, error) {
+	if len(data) > 127 {
+		return nil, fmt.Errorf("%v bytes do not fit in one cell, max is 127; use WriteBinary to continue them in refs", len(data))
+	}
+	c := NewCell()
+	err := c.Bits.WriteBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// CellFromTopUpped creates a cell with the first bitLen bits of data and the given
+// refs. The length is taken as is, so a completion bit in data, if any, is ignored
+// along with all other bits after bitLen. DataBytes gives data and bitLen back.
+func CellFromTopUpped(data []byte, bitLen int, refs []*Cell) (*Cell, error) {
+	if bitLen < 0 || bitLen > 1023 {
+		return nil, fmt.Errorf("invalid cell bit length %v", bitLen)
+	}
+	if len(data) < (bitLen+7)/8 {
+		return nil, fmt.Errorf("%v bytes are not enough for %v bits", len(data), bitLen)
+	}
+	c := NewCell()
+	for i := 0; i < bitLen; i++ {
+		err := c.Bits.WriteBit(data[i/8]&(1<<(7-i%8)) != 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err := c.AddReferences(refs...)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// BytesToBoc serializes BytesToCell(data) with the ToBoc options.
+func BytesToBoc(data []byte) ([]byte, error) {
+	c, err := BytesToCell(data)
+	if err != nil {
+		return nil, err
+	}
+	return c.ToBoc()
+}
+
 func (c *Cell) BeginParse() BitStringReader {
-	return NewBitStringReader(&c.Bits)
+	r := NewBitStringReader(&c.Bits)
+	r.refs = c.refs
+	return r
+}
+
+// LoadRef returns a reader positioned at the start of the i-th ref.
+func (c *Cell) LoadRef(i int) (BitStringReader, error) {
+	r := c.BeginParse()
+	return r.LoadRef(i)
+}
+
+// LoadOnlyRef returns the ref of a cell that must have exactly one ref, such as a
+// snake or wrapper cell.
+func (c *Cell) LoadOnlyRef() (*Cell, error) {
+	if len(c.refs) != 1 {
+		return nil, fmt.Errorf("cell must have exactly one ref, has %v", len(c.refs))
+	}
+	return c.refs[0], nil
+}
+
+// LoadEitherRefOrInline reads the selector bit of Either X ^X from r, which must be
+// a reader of c. For the inline variant the returned reader continues at the
+// current position of r; otherwise it reads the next ref of c not yet taken through r.
+func (c *Cell) LoadEitherRefOrInline(r *BitStringReader) (BitStringReader, error) {
+	if r.Available() < 1 {
+		return BitStringReader{}, errNotEnoughBits
+	}
+	if !r.ReadBit() {
+		return *r, nil
+	}
+	if r.refCursor >= len(c.refs) {
+		return BitStringReader{}, errors.New("not enough refs")
+	}
+	ref := c.refs[r.refCursor]
+	r.refCursor++
+	return ref.BeginParse(), nil
 }
 
 func (c *Cell) RefsSize() int {
-	return len(c.Refs())
+	return len(c.refs)
+}
+
+// IsLeaf reports whether the cell has no refs.
+func (c *Cell) IsLeaf() bool {
+	return len(c.refs) == 0
+}
+
+// HasRefs reports whether the cell has at least one ref, the opposite of IsLeaf.
+func (c *Cell) HasRefs() bool {
+	return len(c.refs) > 0
 }
 
+// Refs returns the refs in the order they were added. The returned slice must not be modified.
 func (c *Cell) Refs() []*Cell {
-	res := make([]*Cell, 0)
-	for _, ref := range c.refs {
-		if ref != nil {
-			res = append(res, ref)
-		}
-	}
-	return res
-	//return c.refs
+	return c.refs
 }
 
 func (c *Cell) IsExotic() bool {
 	return c.isExotic
 }
 
+// BocOptions returns the header flags of the boc the cell was deserialized from.
+// Only root cells deserialized without a cache have them.
+func (c *Cell) BocOptions() (BocSerializeOptions, bool) {
+	if c.bocOptions == nil {
+		return BocSerializeOptions{}, false
+	}
+	return *c.bocOptions, true
+}
+
 func (c *Cell) BitSize() int {
 	return c.Bits.Cursor()
 }
 
+// DataBytes returns a copy of the cell data and its length in bits. If the length is
+// not a multiple of 8, the last byte is completed with a one bit followed by zeros,
+// the same way as in the boc encoding. Bits after the length are never exposed.
+func (c *Cell) DataBytes() ([]byte, int) {
+	res, _ := c.Bits.GetTopUppedArray()
+	return res, c.BitSize()
+}
+
+// TopUppedBytes returns the cell data in the form taken by SetTopUppedArray: the
+// bytes and whether the last one is fully filled, i.e. has no completion bit.
+func (c *Cell) TopUppedBytes() ([]byte, bool) {
+	data, bitSize := c.DataBytes()
+	return data, bitSize%8 == 0
+}
+
+// Hash returns the representation hash of the cell, i.e. the hash of its highest level.
 func (c *Cell) Hash() []byte {
 	return hashCell(c)
 }
 
+// LevelHash returns the hash of the cell at the given level. Level 0 is the hash of
+// the cell with all pruned branches replaced by the cells they stand for, levels over
+// the cell level give the representation hash.
+func (c *Cell) LevelHash(level int) []byte {
+	hash := computeCellHashes(c, map[*Cell]*cellHashes{}).hash(level)
+	return hash[:]
+}
+
+// Depth16 returns the cell depth as stored in the cell representation. Depths over
+// 65535 can't be represented and mean a malformed tree.
+func (c *Cell) Depth16() (uint16, error) {
+	return c.LevelDepth(maxLevel)
+}
+
+// LevelDepth returns the cell depth at the given level, the depth stored next to
+// LevelHash(level).
+func (c *Cell) LevelDepth(level int) (uint16, error) {
+	return depth16(computeCellHashes(c, map[*Cell]*cellHashes{}).depth(level))
+}
+
+// Representation returns the bytes hashed by Hash: descriptors, data with the
+// completion tag or the previous level hash, depths and hashes of the refs.
+func (c *Cell) Representation() []byte {
+	return hashRepr(c)
+}
+
 func (c *Cell) HashString() string {
 	return hex.EncodeToString(hashCell(c))
 }
 
+// Stats returns the number of unique cells, and the total number of data bits and
+// refs in them. Cells are deduplicated the same way as on serialization.
+func (c *Cell) Stats() (cells int, bits int, refs int) {
+	allCells, _ := topologicalSort(c)
+	for _, cell := range allCells {
+		bits += cell.BitSize()
+		refs += cell.RefsSize()
+	}
+	return len(allCells), bits, refs
+}
+
+// WalkRefs calls fn for every cell reachable from c, depth-first and in ref order.
+// Direct refs of c have depth 1. Shared cells are visited once per path to them.
+// The walk stops at the first error returned by fn.
+func (c *Cell) WalkRefs(fn func(depth int, c *Cell) error) error {
+	return c.walkRefs(1, fn)
+}
+
+func (c *Cell) walkRefs(depth int, fn func(depth int, c *Cell) error) error {
+	for _, ref := range c.refs {
+		err := fn(depth, ref)
+		if err != nil {
+			return err
+		}
+		err = ref.walkRefs(depth+1, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Leaves returns the cells without refs in depth-first order. Leaves with the same
+// hash are returned once.
+func (c *Cell) Leaves() []*Cell {
+	res := make([]*Cell, 0)
+	visited := make(map[*Cell]bool)
+	hashes := make(map[string]bool)
+	var walk func(c *Cell)
+	walk = func(c *Cell) {
+		if visited[c] {
+			return
+		}
+		visited[c] = true
+		if len(c.refs) == 0 {
+			h := c.HashString()
+			if !hashes[h] {
+				hashes[h] = true
+				res = append(res, c)
+			}
+			return
+		}
+		for _, ref := range c.refs {
+			walk(ref)
+		}
+	}
+	walk(c)
+	return res
+}
+
+// Map returns a tree where every cell is replaced by the result of fn. Cells are
+// passed bottom-up, so fn gets a cell with already mapped refs; a cell whose refs
+// changed is passed as a new copy. The input tree is never modified, and cells
+// shared by several parents are mapped once.
+func (c *Cell) Map(fn func(*Cell) (*Cell, error)) (*Cell, error) {
+	return c.mapCells(fn, make(map[*Cell]*Cell))
+}
+
+func (c *Cell) mapCells(fn func(*Cell) (*Cell, error), seen map[*Cell]*Cell) (*Cell, error) {
+	if res, ok := seen[c]; ok {
+		return res, nil
+	}
+
+	refs := make([]*Cell, len(c.refs))
+	changed := false
+	for i, ref := range c.refs {
+		mapped, err := ref.mapCells(fn, seen)
+		if err != nil {
+			return nil, err
+		}
+		refs[i] = mapped
+		changed = changed || mapped != ref
+	}
+
+	cell := c
+	if changed {
+		cell = &Cell{
+			Bits:     copyCellBits(&c.Bits),
+			isExotic: c.isExotic,
+			refs:     refs,
+		}
+	}
+	res, err := fn(cell)
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		return nil, errors.New("map function returned a nil cell")
+	}
+	seen[c] = res
+	return res, nil
+}
+
 func (c *Cell) ToBoc() ([]byte, error) {
 	return SerializeBoc(c, true, true, false, 0)
 }
 
+// ToBocCompact serializes without the index and crc32c, which gives the smallest
+// boc. Use it for messages sent over the wire.
+func (c *Cell) ToBocCompact() ([]byte, error) {
+	return c.ToBocCustom(false, false, false, 0)
+}
+
+// ToBocStandard serializes with the index and crc32c, same as ToBoc.
+func (c *Cell) ToBocStandard() ([]byte, error) {
+	return c.ToBocCustom(true, true, false, 0)
+}
+
 func (c *Cell) ToBocString() (string, error) {
 	return c.ToBocStringCustom(true, true, false, 0)
 }
@@ -75,6 +328,9 @@ func (c *Cell) ToBocBase64() (string, error) {
 	return c.ToBocBase64Custom(true, true, false, 0)
 }
 
+// ToBocCustom serializes with the given header flags. The flags only change the
+// boc layout: cell and message hashes are computed from the cells and are the
+// same for every flag set, so there is no separate set of flags for hashing.
 func (c *Cell) ToBocCustom(idx bool, hasCrc32 bool, cacheBits bool, flags int) ([]byte, error) {
 	return SerializeBoc(c, idx, hasCrc32, cacheBits, flags)
 }
@@ -95,16 +351,128 @@ func (c *Cell) ToBocBase64Custom(idx bool, hasCrc32 bool, cacheBits bool, flags
 	return base64.StdEncoding.EncodeToString(boc), nil
 }
 
+func (c *Cell) ToBocBase64URL() (string, error) {
+	return c.ToBocBase64URLCustom(true, true, false, 0)
+}
+
+// ToBocBase64URLCustom encodes the boc as URL-safe base64 without padding.
+func (c *Cell) ToBocBase64URLCustom(idx bool, hasCrc32 bool, cacheBits bool, flags int) (string, error) {
+	boc, err := c.ToBocCustom(idx, hasCrc32, cacheBits, flags)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(boc), nil
+}
+
 func (c *Cell) AddReference(c2 *Cell) (*Cell, error) {
 	if c.RefsSize() == 4 {
 		return c, errors.New("cell references are filled")
 	}
+	if c2 == nil {
+		return c, errors.New("nil reference")
+	}
 
 	c.refs = append(c.refs, c2)
 
 	return c, nil
 }
 
+// AddReferences adds all refs or none of them if any is nil or they don't fit.
+func (c *Cell) AddReferences(refs ...*Cell) (*Cell, error) {
+	if c.RefsSize()+len(refs) > 4 {
+		return c, errors.New("cell references are filled")
+	}
+	for _, ref := range refs {
+		if ref == nil {
+			return c, errors.New("nil reference")
+		}
+	}
+
+	c.refs = append(c.refs, refs...)
+
+	return c, nil
+}
+
+// SetRef replaces the i-th ref or adds it if i equals the number of refs. Hashes are
+// computed on demand, so the new ref is reflected by the next Hash call.
+func (c *Cell) SetRef(i int, ref *Cell) error {
+	if ref == nil {
+		return errors.New("nil reference")
+	}
+	if i < 0 || i > len(c.refs) {
+		return fmt.Errorf("ref %v is out of range, cell has %v refs", i, len(c.refs))
+	}
+	if i == len(c.refs) {
+		_, err := c.AddReference(ref)
+		return err
+	}
+	c.refs[i] = ref
+	return nil
+}
+
+// Clone returns a copy of the cell with its own data and refs list. Refs point to
+// the same cells as the refs of c.
+func (c *Cell) Clone() *Cell {
+	refs := make([]*Cell, len(c.refs), 4)
+	copy(refs, c.refs)
+	return &Cell{
+		Bits:     copyCellBits(&c.Bits),
+		isExotic: c.isExotic,
+		refs:     refs,
+	}
+}
+
+// copyCellBits copies cell data into a new BitString limited to 1023 bits like the
+// data of any cell. BitString.Copy keeps the whole buffer, which may be longer.
+func copyCellBits(s *BitString) BitString {
+	res := NewBitString(1023)
+	copy(res.buf, s.buf[:(s.cursor+7)/8])
+	res.cursor = s.cursor
+	return res
+}
+
+// cellFromRemainder creates a cell with the unread bits and refs of r. r is not advanced.
+func cellFromRemainder(r *BitStringReader) (*Cell, error) {
+	res := NewCell()
+	rest := *r
+	for rest.Available() > 0 {
+		err := res.Bits.WriteBit(rest.ReadBit())
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, ref := range r.refs[r.refCursor:] {
+		_, err := res.AddReference(ref)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// readMaybeRef reads Maybe ^Cell from r, taking the next ref of r if present.
+func readMaybeRef(r *BitStringReader) (*Cell, error) {
+	if r.Available() < 1 {
+		return nil, errNotEnoughBits
+	}
+	if !r.ReadBit() {
+		return nil, nil
+	}
+	return r.readRef()
+}
+
+// readEitherCell reads Either Cell ^Cell from r. The inline variant is returned as
+// a new cell with the rest of the bits and refs.
+func readEitherCell(r *BitStringReader) (*Cell, error) {
+	if r.Available() < 1 {
+		return nil, errNotEnoughBits
+	}
+	if !r.ReadBit() {
+		return cellFromRemainder(r)
+	}
+	return r.readRef()
+}
+
 func (c *Cell) toStringImpl(ident string) string {
 	s := ident + "x{" + c.Bits.ToFiftHex() + "}\n"
 	for _, ref := range c.Refs() {
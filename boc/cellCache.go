@@ -0,0 +1,50 @@
+package boc
+
+import (
+	"sync"
+)
+
+// CellCache interns deserialized cells by hash, so identical cells from different
+// BOCs share one instance. It is safe for concurrent use.
+type CellCache struct {
+	mu    sync.RWMutex
+	cells map[string]*Cell
+}
+
+func NewCellCache() *CellCache {
+	return &CellCache{
+		cells: make(map[string]*Cell),
+	}
+}
+
+func (c *CellCache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.cells)
+}
+
+// intern returns the cached cell with the same hash, storing the cell if there is none.
+// Hashes are taken from memo, and a cached cell gets the memo entry of cell, so
+// cells referring to it aren't hashed from scratch.
+func (c *CellCache) intern(cell *Cell, memo map[*Cell]*cellHashes) *Cell {
+	hashes := computeCellHashes(cell, memo)
+	hash := memoHashString(cell, memo)
+
+	c.mu.RLock()
+	cached, ok := c.cells[hash]
+	c.mu.RUnlock()
+	if ok {
+		memo[cached] = hashes
+		return cached
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok = c.cells[hash]
+	if ok {
+		memo[cached] = hashes
+		return cached
+	}
+	c.cells[hash] = cell
+	return cell
+}
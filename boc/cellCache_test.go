@@ -0,0 +1,106 @@
+package boc
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestDeserializeBocWithCache(t *testing.T) {
+	code := NewCell()
+	code.Bits.WriteUint(0xff00f4a4, 32)
+
+	var bocs [][]byte
+	for i := 0; i < 2; i++ {
+		root := NewCell()
+		root.Bits.WriteUint(i, 8)
+		root.AddReference(code)
+		b, err := root.ToBoc()
+		if err != nil {
+			t.Fatal(err)
+		}
+		bocs = append(bocs, b)
+	}
+
+	cache := NewCellCache()
+	first, err := DeserializeBocWithCache(bocs[0], cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := DeserializeBocWithCache(bocs[1], cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first[0].Refs()[0] != second[0].Refs()[0] {
+		t.Fatal("code cell must be shared between bocs")
+	}
+	if first[0] == second[0] {
+		t.Fatal("different roots must not be shared")
+	}
+	if cache.Len() != 3 {
+		t.Fatalf("expected 3 cached cells, got %v", cache.Len())
+	}
+}
+
+func TestDeserializeBocWithCacheLongChain(t *testing.T) {
+	// every cell is hashed once, so a long chain takes as long as without the cache
+	c := NewCell()
+	for i := 0; i < 20000; i++ {
+		parent := NewCell()
+		parent.Bits.WriteUint(i, 16)
+		parent.AddReference(c)
+		c = parent
+	}
+	data, err := c.ToBoc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewCellCache()
+	for i := 0; i < 2; i++ {
+		roots, err := DeserializeBocWithCache(data, cache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if roots[0].HashString() != c.HashString() {
+			t.Fatal("invalid root hash")
+		}
+	}
+	if cache.Len() != 20001 {
+		t.Fatalf("expected 20001 cached cells, got %v", cache.Len())
+	}
+}
+
+func TestCellCacheConcurrent(t *testing.T) {
+	root := NewCell()
+	root.Bits.WriteUint(1, 8)
+	child := NewCell()
+	child.Bits.WriteUint(2, 8)
+	root.AddReference(child)
+	b, err := root.ToBoc()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewCellCache()
+	res := make([]*Cell, 16)
+	var wg sync.WaitGroup
+	for i := range res {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cells, err := DeserializeBocWithCache(b, cache)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			res[i] = cells[0]
+		}(i)
+	}
+	wg.Wait()
+
+	for _, c := range res {
+		if c != res[0] {
+			t.Fatal("all goroutines must get the same cell")
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package boc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// maxLevel is the highest level of a cell. Hashes and depths of higher levels are
+// the same as of this one.
+const maxLevel = 3
+
+// cellHashes holds the hashes and depths of a cell for each of its significant
+// levels, from level 0 to the representation level.
+type cellHashes struct {
+	levelMask int
+	hashes    [][32]byte
+	depths    []int
+}
+
+// index returns the position of the hash and depth of the given level.
+func (h *cellHashes) index(level int) int {
+	if level <= 0 {
+		return 0
+	}
+	if level > maxLevel {
+		level = maxLevel
+	}
+	return bits.OnesCount(uint(h.levelMask & (1<<level - 1)))
+}
+
+// level returns the representation level of the cell.
+func (h *cellHashes) level() int {
+	return bits.Len(uint(h.levelMask))
+}
+
+func (h *cellHashes) hash(level int) [32]byte {
+	return h.hashes[h.index(level)]
+}
+
+func (h *cellHashes) depth(level int) int {
+	return h.depths[h.index(level)]
+}
+
+// depth16 converts a cell depth to the 16 bits it is stored in.
+func depth16(depth int) (uint16, error) {
+	if depth > math.MaxUint16 {
+		return 0, fmt.Errorf("cell depth %v exceeds 65535", depth)
+	}
+	return uint16(depth), nil
+}
+
+// prunedLevelMask returns the level mask of a pruned branch, or 0 if its data
+// doesn't have the hashes and depths the mask requires.
+func prunedLevelMask(c *Cell) int {
+	if c.BitSize() < 16 {
+		return 0
+	}
+	mask := int(c.Bits.buf[1])
+	if mask == 0 || mask > 7 {
+		return 0
+	}
+	if c.BitSize() != 16+bits.OnesCount(uint(mask))*(256+16) {
+		return 0
+	}
+	return mask
+}
+
+// computeCellHashes computes hashes and depths of c for all levels. Results for
+// every visited cell are kept in memo, so shared cells are hashed once.
+func computeCellHashes(c *Cell, memo map[*Cell]*cellHashes) *cellHashes {
+	if h, ok := memo[c]; ok {
+		return h
+	}
+
+	refs := make([]*cellHashes, len(c.refs))
+	for i, ref := range c.refs {
+		refs[i] = computeCellHashes(ref, memo)
+	}
+
+	typ := c.Type()
+	res := &cellHashes{}
+	switch typ {
+	case PrunedBranchCell:
+		res.levelMask = prunedLevelMask(c)
+	case LibraryCell, UnknownCell:
+	default:
+		for _, r := range refs {
+			res.levelMask |= r.levelMask
+		}
+		if typ == MerkleProofCell || typ == MerkleUpdateCell {
+			res.levelMask >>= 1
+		}
+	}
+
+	// a pruned branch stores the hashes and depths of all levels below its own
+	hashCount := bits.OnesCount(uint(res.levelMask)) + 1
+	stored := 0
+	if typ == PrunedBranchCell && res.levelMask != 0 {
+		stored = hashCount - 1
+		data := c.Bits.buf[2:]
+		for i := 0; i < stored; i++ {
+			var hash [32]byte
+			copy(hash[:], data[i*32:])
+			res.hashes = append(res.hashes, hash)
+			res.depths = append(res.depths, int(binary.BigEndian.Uint16(data[stored*32+i*2:])))
+		}
+	}
+
+	var scratch [32]byte
+	hashI := 0
+	for level := 0; level <= res.level(); level++ {
+		if level > 0 && res.levelMask&(1<<(level-1)) == 0 {
+			continue
+		}
+		if hashI < stored {
+			hashI++
+			continue
+		}
+
+		h := newCellHasher()
+		depth := writeLevelRepr(h, c, res, refs, level, hashI == stored)
+		var hash [32]byte
+		copy(hash[:], h.Sum(scratch[:0]))
+		res.hashes = append(res.hashes, hash)
+		res.depths = append(res.depths, depth)
+		hashI++
+	}
+
+	memo[c] = res
+	return res
+}
+
+// writeLevelRepr writes the representation of c hashed for the given level and
+// returns the depth of that level. The first computed level hashes the cell data,
+// higher levels hash the previous level hash instead, so h must hold the levels below.
+func writeLevelRepr(w io.Writer, c *Cell, h *cellHashes, refs []*cellHashes, level int, first bool) int {
+	var scratch [32]byte
+	bitSize := c.BitSize()
+	scratch[0], scratch[1] = cellDescriptors(len(c.refs), c.isExotic, h.levelMask&(1<<level-1), bitSize)
+	w.Write(scratch[:2])
+
+	if first {
+		w.Write(c.Bits.buf[:bitSize/8])
+		if bitSize%8 != 0 {
+			rem := bitSize % 8
+			scratch[0] = c.Bits.buf[bitSize/8]&(0xff<<(8-rem)) | 1<<(7-rem)
+			w.Write(scratch[:1])
+		}
+	} else {
+		prev := h.hashes[h.index(level)-1]
+		w.Write(prev[:])
+	}
+
+	// merkle cells hash their refs one level higher
+	refLevel := level
+	if typ := c.Type(); typ == MerkleProofCell || typ == MerkleUpdateCell {
+		refLevel++
+	}
+	depth := 0
+	for _, r := range refs {
+		d := r.depth(refLevel)
+		if d+1 > depth {
+			depth = d + 1
+		}
+		// depths over 65535 are rejected by Depth16 on serialization
+		binary.BigEndian.PutUint16(scratch[:], uint16(d))
+		w.Write(scratch[:2])
+	}
+	for _, r := range refs {
+		hash := r.hash(refLevel)
+		w.Write(hash[:])
+	}
+	return depth
+}
@@ -0,0 +1,661 @@
+package boc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestLoadRef(t *testing.T) {
+	child := NewCell()
+	child.Bits.WriteUint(0xabcd, 16)
+	c := NewCell()
+	c.AddReference(child)
+
+	r, err := c.LoadRef(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mustReadUint(t, &r, 16) != 0xabcd {
+		t.Fatal("reader must start at the ref bits")
+	}
+
+	_, err = c.LoadRef(1)
+	if err == nil {
+		t.Fatal("expected missing ref error")
+	}
+	if !strings.Contains(err.Error(), "ref 1") {
+		t.Fatalf("error must name the missing index: %v", err)
+	}
+}
+
+func TestRefsOrder(t *testing.T) {
+	a := NewCell()
+	a.Bits.WriteUint(1, 8)
+	b := NewCell()
+	b.Bits.WriteUint(2, 8)
+
+	ab := NewCell()
+	ab.AddReference(a)
+	ab.AddReference(b)
+	ba := NewCell()
+	ba.AddReference(b)
+	ba.AddReference(a)
+
+	if len(ab.Refs()) != 2 || ab.Refs()[0] != a || ab.Refs()[1] != b {
+		t.Fatal("refs must be kept in insertion order")
+	}
+
+	// descriptors, 2 depths, then ref hashes in insertion order
+	repr := hashRepr(ab)
+	if len(repr) != 2+2*2+2*32 {
+		t.Fatalf("invalid repr length %v", len(repr))
+	}
+	if !bytes.Equal(repr[6:38], a.Hash()) || !bytes.Equal(repr[38:70], b.Hash()) {
+		t.Fatal("ref hashes must follow insertion order")
+	}
+
+	if ab.HashString() == ba.HashString() {
+		t.Fatal("reordering refs must change the hash")
+	}
+
+	data, err := ba.ToBoc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := DeserializeBoc(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed[0].HashString() != ba.HashString() {
+		t.Fatal("refs order must survive a round-trip")
+	}
+}
+
+func TestAddReferenceLimit(t *testing.T) {
+	c := NewCell()
+	for i := 0; i < 4; i++ {
+		_, err := c.AddReference(NewCell())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := c.AddReference(NewCell())
+	if err == nil {
+		t.Fatal("expected error for the fifth ref")
+	}
+	if c.RefsSize() != 4 {
+		t.Fatal("failed AddReference must not change refs")
+	}
+	_, err = NewCell().AddReference(nil)
+	if err == nil {
+		t.Fatal("expected error for nil ref")
+	}
+}
+
+func TestWalkRefs(t *testing.T) {
+	leaf := NewCell()
+	leaf.Bits.WriteUint(3, 8)
+	a := NewCell()
+	a.Bits.WriteUint(1, 8)
+	a.AddReference(leaf)
+	b := NewCell()
+	b.Bits.WriteUint(2, 8)
+	root := NewCell()
+	root.AddReference(a)
+	root.AddReference(b)
+
+	var visited []string
+	err := root.WalkRefs(func(depth int, c *Cell) error {
+		visited = append(visited, fmt.Sprintf("%v:%v", depth, c.Bits.ToFiftHex()))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(visited, " ") != "1:01 2:03 1:02" {
+		t.Fatalf("invalid walk order: %v", visited)
+	}
+
+	stop := errors.New("stop")
+	count := 0
+	err = root.WalkRefs(func(depth int, c *Cell) error {
+		count++
+		if depth == 2 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || count != 2 {
+		t.Fatalf("walk must stop at the first error, got %v after %v cells", err, count)
+	}
+}
+
+func TestToBocBase64URL(t *testing.T) {
+	c := NewCell()
+	c.Bits.WriteBytes([]byte{0xfb, 0xef, 0xff, 0xfb, 0xef, 0xff})
+	s, err := c.ToBocBase64URL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.ContainsAny(s, "+/=") {
+		t.Fatalf("output must be url-safe without padding: %v", s)
+	}
+	cells, err := DeserializeBocBase64URL(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := cells[0].ToBocBase64URL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != s {
+		t.Fatalf("round-trip is not stable: %v != %v", again, s)
+	}
+}
+
+func TestToBocCompact(t *testing.T) {
+	c := wideTree()
+	compact, err := c.ToBocCompact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := c.ToBoc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cells, _, _ := c.Stats()
+	if len(full)-len(compact) != cells+4 {
+		t.Fatalf("compact boc must drop the index and crc: %v vs %v bytes", len(compact), len(full))
+	}
+	header, err := parseBocHeader(compact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.hasIdx || header.hashCrc32 {
+		t.Fatal("compact boc must have no index and no crc")
+	}
+	res, err := DeserializeBoc(compact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[0].HashString() != c.HashString() {
+		t.Fatal("invalid root after round-trip")
+	}
+}
+
+func TestRepresentation(t *testing.T) {
+	child := NewCell()
+	child.Bits.WriteUint(0xab, 8)
+	c := NewCell()
+	c.Bits.WriteUint(1, 1)
+	c.AddReference(child)
+
+	childHash := sha256.Sum256([]byte{0x00, 0x02, 0xab})
+	want := append([]byte{0x01, 0x01, 0xc0, 0x00, 0x00}, childHash[:]...)
+	if !bytes.Equal(c.Representation(), want) {
+		t.Fatalf("invalid representation %x", c.Representation())
+	}
+	hash := sha256.Sum256(want)
+	if !bytes.Equal(c.Hash(), hash[:]) {
+		t.Fatal("hash must be sha256 of the representation")
+	}
+}
+
+func TestLoadEitherRefOrInline(t *testing.T) {
+	inline := NewCell()
+	inline.Bits.WriteBit(false)
+	inline.Bits.WriteUint(0x1234, 16)
+	r := inline.BeginParse()
+	body, err := inline.LoadEitherRefOrInline(&r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mustReadUint(t, &body, 16) != 0x1234 {
+		t.Fatal("inline body must continue after the selector bit")
+	}
+
+	first := NewCell()
+	first.Bits.WriteUint(0xaa, 8)
+	second := NewCell()
+	second.Bits.WriteUint(0xbb, 8)
+	refs := NewCell()
+	refs.Bits.WriteBit(true)
+	refs.Bits.WriteBit(true)
+	refs.AddReference(first)
+	refs.AddReference(second)
+	r = refs.BeginParse()
+	for _, want := range []uint{0xaa, 0xbb} {
+		body, err = refs.LoadEitherRefOrInline(&r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mustReadUint(t, &body, 8) != want {
+			t.Fatalf("expected ref with %x", want)
+		}
+	}
+
+	missing := NewCell()
+	missing.Bits.WriteBit(true)
+	r = missing.BeginParse()
+	_, err = missing.LoadEitherRefOrInline(&r)
+	if err == nil {
+		t.Fatal("expected not enough refs error")
+	}
+}
+
+func TestBytesToBoc(t *testing.T) {
+	data := bytes.Repeat([]byte{0x5a}, 127)
+	b, err := BytesToBoc(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cells, err := DeserializeBoc(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cells[0].Bits.Buffer()[:127], data) || cells[0].BitSize() != 127*8 || cells[0].RefsSize() != 0 {
+		t.Fatal("invalid cell data")
+	}
+
+	_, err = BytesToCell(append(data, 0))
+	if err == nil || !strings.Contains(err.Error(), "WriteBinary") {
+		t.Fatalf("expected an error pointing to WriteBinary, got %v", err)
+	}
+}
+
+func TestIsLeaf(t *testing.T) {
+	c := NewCell()
+	if !c.IsLeaf() || c.HasRefs() {
+		t.Fatal("new cell must be a leaf")
+	}
+	c.AddReference(NewCell())
+	if c.IsLeaf() || !c.HasRefs() || c.RefsSize() != 1 {
+		t.Fatal("cell with a ref must not be a leaf")
+	}
+}
+
+func TestDepth16(t *testing.T) {
+	c := NewCell()
+	for i := 0; i < 65535; i++ {
+		parent := NewCell()
+		parent.AddReference(c)
+		c = parent
+	}
+	depth, err := c.Depth16()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if depth != 65535 {
+		t.Fatalf("expected depth 65535, got %v", depth)
+	}
+
+	parent := NewCell()
+	parent.AddReference(c)
+	_, err = parent.Depth16()
+	if err == nil {
+		t.Fatal("depth 65536 must be rejected")
+	}
+	_, err = parent.ToBoc()
+	if err == nil {
+		t.Fatal("cell with depth 65536 must not be serialized")
+	}
+}
+
+func TestToBocStandard(t *testing.T) {
+	c := wideTree()
+	standard, err := c.ToBocStandard()
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := c.ToBoc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(standard, def) {
+		t.Fatal("ToBocStandard must match ToBoc")
+	}
+	header, err := parseBocHeader(standard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !header.hasIdx || !header.hashCrc32 || header.hasCacheBits {
+		t.Fatal("standard boc must have the index and crc only")
+	}
+	cells, err := DeserializeBoc(standard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cells[0].HashString() != c.HashString() {
+		t.Fatal("invalid root after round-trip")
+	}
+}
+
+func TestDataBytes(t *testing.T) {
+	c := NewCell()
+	c.Bits.WriteUint(0xabc, 12)
+	data, bitLen := c.DataBytes()
+	if bitLen != 12 || !bytes.Equal(data, []byte{0xab, 0xc8}) {
+		t.Fatalf("invalid data %x of %v bits", data, bitLen)
+	}
+
+	data[0] = 0
+	if c.Bits.Buffer()[0] != 0xab {
+		t.Fatal("returned data must not alias the cell")
+	}
+
+	full, err := BytesToCell([]byte{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, bitLen = full.DataBytes()
+	if bitLen != 24 || !bytes.Equal(data, []byte{1, 2, 3}) {
+		t.Fatalf("invalid data %x of %v bits", data, bitLen)
+	}
+}
+
+func TestAddReferences(t *testing.T) {
+	c := NewCell()
+	_, err := c.AddReferences(NewCell(), NewCell(), NewCell())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.AddReferences(NewCell(), NewCell())
+	if err == nil {
+		t.Fatal("fifth ref must fail")
+	}
+	if c.RefsSize() != 3 {
+		t.Fatalf("failed call must not add refs, got %v", c.RefsSize())
+	}
+	_, err = c.AddReferences(nil)
+	if err == nil || c.RefsSize() != 3 {
+		t.Fatal("nil ref must fail without adding refs")
+	}
+	_, err = c.AddReferences(NewCell())
+	if err != nil || c.RefsSize() != 4 {
+		t.Fatal("fourth ref must be added")
+	}
+}
+
+func TestTopUppedBytes(t *testing.T) {
+	for n := 0; n <= 24; n++ {
+		c := NewCell()
+		c.Bits.WriteUint(0xa5c3f1>>(24-n), n)
+		data, full := c.TopUppedBytes()
+		if full != (n%8 == 0) {
+			t.Fatalf("%v bits: invalid fullness flag", n)
+		}
+
+		res := NewCell()
+		err := res.Bits.SetTopUppedArray(data, full)
+		if err != nil {
+			t.Fatalf("%v bits: %v", n, err)
+		}
+		if res.BitSize() != n || res.HashString() != c.HashString() {
+			t.Fatalf("%v bits: cell doesn't round-trip", n)
+		}
+	}
+}
+
+func TestMap(t *testing.T) {
+	placeholder := NewCell()
+	placeholder.Bits.WriteUint(0xff, 8)
+	kept := NewCell()
+	kept.Bits.WriteUint(1, 8)
+	mid := NewCell()
+	mid.AddReference(placeholder)
+	root := NewCell()
+	root.AddReference(mid)
+	root.AddReference(kept)
+	root.AddReference(placeholder)
+	rootHash := root.HashString()
+
+	value := NewCell()
+	value.Bits.WriteUint(42, 32)
+	calls := 0
+	res, err := root.Map(func(c *Cell) (*Cell, error) {
+		calls++
+		if c == placeholder {
+			return value, nil
+		}
+		return c, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 4 {
+		t.Fatalf("shared cells must be mapped once, got %v calls", calls)
+	}
+	if root.HashString() != rootHash || mid.refs[0] != placeholder {
+		t.Fatal("input tree must not change")
+	}
+	if res == root || res.refs[0] == mid || res.refs[0].refs[0] != value || res.refs[2] != value {
+		t.Fatal("placeholder is not replaced")
+	}
+	if res.refs[1] != kept {
+		t.Fatal("unchanged subtrees must be kept")
+	}
+
+	same, err := root.Map(func(c *Cell) (*Cell, error) { return c, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same != root {
+		t.Fatal("identity map must return the same tree")
+	}
+
+	_, err = root.Map(func(c *Cell) (*Cell, error) { return nil, nil })
+	if err == nil {
+		t.Fatal("nil result must fail")
+	}
+}
+
+func TestCopiedCellBitLimit(t *testing.T) {
+	full := NewCell()
+	full.Bits.WriteUint(0, 1023)
+	clone := full.Clone()
+	if clone.Bits.WriteBit(true) == nil {
+		t.Fatal("clone must not take more than 1023 bits")
+	}
+
+	ref := NewCell()
+	full.AddReference(ref)
+	mapped, err := full.Map(func(c *Cell) (*Cell, error) {
+		if c == ref {
+			return NewCell(), nil
+		}
+		return c, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapped == full || mapped.Bits.WriteBit(true) == nil {
+		t.Fatal("mapped cell must not take more than 1023 bits")
+	}
+
+	// deserialized cells keep only their data, their clones get the full limit
+	small := NewCell()
+	small.Bits.WriteUint(5, 3)
+	data, err := small.ToBoc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cells, err := DeserializeBoc(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone = cells[0].Clone()
+	if clone.Bits.WriteUint(0, 1020) != nil || clone.Bits.WriteBit(true) == nil {
+		t.Fatal("clone of a deserialized cell must take up to 1023 bits")
+	}
+}
+
+func TestCellFromTopUpped(t *testing.T) {
+	ref := NewCell()
+	for n := 0; n <= 24; n++ {
+		c := NewCell()
+		c.Bits.WriteUint(0xa5c3f1>>(24-n), n)
+		c.AddReference(ref)
+
+		data, bitLen := c.DataBytes()
+		res, err := CellFromTopUpped(data, bitLen, []*Cell{ref})
+		if err != nil {
+			t.Fatalf("%v bits: %v", n, err)
+		}
+		if res.BitSize() != n || res.HashString() != c.HashString() {
+			t.Fatalf("%v bits: cell doesn't round-trip", n)
+		}
+	}
+
+	// no completion bit: the length comes from bitLen only
+	res, err := CellFromTopUpped([]byte{0xab, 0xcf}, 12, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Bits.ToFiftHex() != "ABC" {
+		t.Fatalf("invalid bits %v", res.Bits.ToFiftHex())
+	}
+
+	_, err = CellFromTopUpped([]byte{0xab}, 12, nil)
+	if err == nil {
+		t.Fatal("short data must fail")
+	}
+	_, err = CellFromTopUpped(make([]byte, 128), 1024, nil)
+	if err == nil {
+		t.Fatal("too long cell must fail")
+	}
+	_, err = CellFromTopUpped(nil, 0, []*Cell{ref, ref, ref, ref, ref})
+	if err == nil {
+		t.Fatal("five refs must fail")
+	}
+}
+
+func TestSetRef(t *testing.T) {
+	a := NewCell()
+	a.Bits.WriteUint(1, 8)
+	b := NewCell()
+	b.Bits.WriteUint(2, 8)
+	c := NewCell()
+	c.AddReference(a)
+	before := c.HashString()
+
+	clone := c.Clone()
+	err := clone.SetRef(0, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clone.HashString() == before {
+		t.Fatal("hash must change with the ref")
+	}
+	if c.HashString() != before || c.refs[0] != a {
+		t.Fatal("clone must not change the original cell")
+	}
+
+	err = clone.SetRef(1, a)
+	if err != nil || clone.RefsSize() != 2 {
+		t.Fatal("ref after the last one must be added")
+	}
+	err = clone.SetRef(3, a)
+	if err == nil {
+		t.Fatal("gap in refs must fail")
+	}
+	err = clone.SetRef(0, nil)
+	if err == nil {
+		t.Fatal("nil ref must fail")
+	}
+}
+
+// Hashes and depths are computed from the current content on every call, so no
+// mutation may leave a stale value behind.
+func TestMutationChangesHash(t *testing.T) {
+	leaf := NewCell()
+	c := NewCell()
+	c.Bits.WriteUint(1, 8)
+
+	steps := []struct {
+		name   string
+		mutate func()
+	}{
+		{"write bits", func() { c.Bits.WriteUint(2, 8) }},
+		{"add ref", func() { c.AddReference(leaf) }},
+		{"set ref", func() {
+			other := NewCell()
+			other.AddReference(NewCell())
+			c.SetRef(0, other)
+		}},
+		{"mutate ref", func() { c.refs[0].Bits.WriteBit(true) }},
+		{"set bit", func() { c.Bits.Toggle(0) }},
+	}
+	hash := c.HashString()
+	depth, _ := c.Depth16()
+	for _, s := range steps {
+		s.mutate()
+		if c.HashString() == hash {
+			t.Fatalf("%v: hash must change", s.name)
+		}
+		hash = c.HashString()
+	}
+	if d, _ := c.Depth16(); d != depth+2 {
+		t.Fatalf("depth must follow the refs, got %v", d)
+	}
+
+	clone := c.Clone()
+	if clone.HashString() != hash {
+		t.Fatal("clone must have the same hash")
+	}
+	clone.Bits.WriteBit(true)
+	if clone.HashString() == hash || c.HashString() != hash {
+		t.Fatal("clone must be hashed from its own content")
+	}
+}
+
+func TestLeaves(t *testing.T) {
+	shared := NewCell()
+	shared.Bits.WriteUint(1, 8)
+	copyOfShared := NewCell()
+	copyOfShared.Bits.WriteUint(1, 8)
+	other := NewCell()
+	other.Bits.WriteUint(2, 8)
+	mid := NewCell()
+	mid.AddReference(shared)
+	mid.AddReference(other)
+	root := NewCell()
+	root.AddReference(mid)
+	root.AddReference(shared)
+	root.AddReference(copyOfShared)
+
+	leaves := root.Leaves()
+	if len(leaves) != 2 || leaves[0] != shared || leaves[1] != other {
+		t.Fatalf("expected the shared and the other leaf, got %v leaves", len(leaves))
+	}
+
+	single := shared.Leaves()
+	if len(single) != 1 || single[0] != shared {
+		t.Fatal("a cell without refs is its own leaf")
+	}
+}
+
+func TestLoadOnlyRef(t *testing.T) {
+	ref := NewCell()
+	c := NewCell()
+	_, err := c.LoadOnlyRef()
+	if err == nil {
+		t.Fatal("cell without refs must fail")
+	}
+	c.AddReference(ref)
+	res, err := c.LoadOnlyRef()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != ref {
+		t.Fatal("invalid ref")
+	}
+	c.AddReference(ref)
+	_, err = c.LoadOnlyRef()
+	if err == nil {
+		t.Fatal("cell with two refs must fail")
+	}
+}
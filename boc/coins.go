@@ -0,0 +1,73 @@
+package boc
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+const coinsDecimals = 9
+
+var nanotonsInTon = big.NewInt(1000000000)
+
+// FormatCoins renders nanotons as a decimal amount of TON without trailing zeros
+// in the fractional part, e.g. 1500000000 as "1.5".
+func FormatCoins(nano *big.Int) string {
+	sign := ""
+	abs := new(big.Int).Set(nano)
+	if abs.Sign() < 0 {
+		sign = "-"
+		abs.Neg(abs)
+	}
+	whole, frac := new(big.Int).QuoRem(abs, nanotonsInTon, new(big.Int))
+	if frac.Sign() == 0 {
+		return sign + whole.String()
+	}
+	fracStr := fmt.Sprintf("%0*d", coinsDecimals, frac.Int64())
+	return sign + whole.String() + "." + strings.TrimRight(fracStr, "0")
+}
+
+// ParseCoins parses a decimal amount of TON into nanotons. Amounts with non-zero
+// digits below 1 nanoton are rejected.
+func ParseCoins(ton string) (*big.Int, error) {
+	s := ton
+	neg := strings.HasPrefix(s, "-")
+	if neg {
+		s = s[1:]
+	}
+	whole, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		whole, frac = s[:i], s[i+1:]
+		if frac == "" {
+			return nil, fmt.Errorf("invalid coins amount %q", ton)
+		}
+	}
+	if whole == "" || !isDecimalDigits(whole) || !isDecimalDigits(frac) {
+		return nil, fmt.Errorf("invalid coins amount %q", ton)
+	}
+	if len(frac) > coinsDecimals {
+		if strings.TrimRight(frac[coinsDecimals:], "0") != "" {
+			return nil, fmt.Errorf("coins amount %q is below 1 nanoton precision", ton)
+		}
+		frac = frac[:coinsDecimals]
+	}
+	frac += strings.Repeat("0", coinsDecimals-len(frac))
+
+	res, ok := new(big.Int).SetString(whole+frac, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid coins amount %q", ton)
+	}
+	if neg {
+		res.Neg(res)
+	}
+	return res, nil
+}
+
+func isDecimalDigits(s string) bool {
+	for _, ch := range s {
+		if ch < '0' || ch > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,50 @@
+package boc
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestFormatCoins(t *testing.T) {
+	large, _ := new(big.Int).SetString("1329227995784915872903807060280344575", 10)
+	cases := []struct {
+		nano *big.Int
+		ton  string
+	}{
+		{big.NewInt(0), "0"},
+		{big.NewInt(1), "0.000000001"},
+		{big.NewInt(1500000000), "1.5"},
+		{big.NewInt(1000000000), "1"},
+		{big.NewInt(-20000000), "-0.02"},
+		{large, "1329227995784915872903807060.280344575"},
+	}
+	for _, c := range cases {
+		if s := FormatCoins(c.nano); s != c.ton {
+			t.Fatalf("%v: expected %q, got %q", c.nano, c.ton, s)
+		}
+		v, err := ParseCoins(c.ton)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Cmp(c.nano) != 0 {
+			t.Fatalf("%q: expected %v, got %v", c.ton, c.nano, v)
+		}
+	}
+}
+
+func TestParseCoins(t *testing.T) {
+	v, err := ParseCoins("2.5000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Int64() != 2500000000 {
+		t.Fatalf("invalid amount %v", v)
+	}
+
+	for _, s := range []string{"", "-", "1.", ".5", "1.2.3", "1e9", "0x10", "+1", "0.0000000001"} {
+		_, err := ParseCoins(s)
+		if err == nil {
+			t.Fatalf("%q must fail", s)
+		}
+	}
+}
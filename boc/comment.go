@@ -0,0 +1,38 @@
+package boc
+
+import (
+	"errors"
+)
+
+// ParseTextComment decodes a text comment message body: a zero 32-bit op followed
+// by the comment as snake data. The text is returned as is, without UTF-8 validation.
+func ParseTextComment(body *Cell) (string, error) {
+	r := body.BeginParse()
+	op, err := r.ReadUint(32)
+	if err != nil {
+		return "", err
+	}
+	if op != 0 {
+		return "", errors.New("not a text comment")
+	}
+	data, err := readSnakeBytes(body, &r)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// CreateTextComment builds a text comment message body. Text that does not fit
+// in the body cell continues in a snake of refs.
+func CreateTextComment(text string) (*Cell, error) {
+	body := NewCell()
+	err := body.Bits.WriteUint(0, 32)
+	if err != nil {
+		return nil, err
+	}
+	err = writeSnakeBytes(body, []byte(text))
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
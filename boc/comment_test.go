@@ -0,0 +1,68 @@
+package boc
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTextComment(t *testing.T) {
+	text := strings.Repeat("a", 123) + "привет"
+	tail := NewCell()
+	tail.Bits.WriteBytes([]byte(text[123:]))
+	body := NewCell()
+	body.Bits.WriteUint(0, 32)
+	body.Bits.WriteBytes([]byte(text[:123]))
+	body.AddReference(tail)
+
+	res, err := ParseTextComment(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != text {
+		t.Fatalf("invalid comment %q", res)
+	}
+
+	op := NewCell()
+	op.Bits.WriteUint(1, 32)
+	_, err = ParseTextComment(op)
+	if err == nil {
+		t.Fatal("non-zero op must be rejected")
+	}
+
+	unaligned := NewCell()
+	unaligned.Bits.WriteUint(0, 32)
+	unaligned.Bits.WriteUint(1, 4)
+	_, err = ParseTextComment(unaligned)
+	if err == nil {
+		t.Fatal("unaligned snake data must be rejected")
+	}
+}
+
+func TestCreateTextComment(t *testing.T) {
+	for _, text := range []string{"", "hello", strings.Repeat("x", 123), strings.Repeat("ж", 200)} {
+		body, err := CreateTextComment(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := ParseTextComment(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != text {
+			t.Fatalf("round-trip failed for %v bytes", len(text))
+		}
+	}
+
+	empty, _ := CreateTextComment("")
+	if empty.BitSize() != 32 || empty.HasRefs() {
+		t.Fatal("empty comment must be just the op")
+	}
+	full, _ := CreateTextComment(strings.Repeat("x", 123))
+	if full.HasRefs() {
+		t.Fatal("123 bytes must fit in the body cell")
+	}
+	long, _ := CreateTextComment(strings.Repeat("x", 123+127+1))
+	if long.RefsSize() != 1 || long.Refs()[0].BitSize() != 127*8 || long.Refs()[0].RefsSize() != 1 {
+		t.Fatal("long comment must continue in full snake cells")
+	}
+}
@@ -0,0 +1,97 @@
+package boc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+)
+
+type corpusBoc struct {
+	name string
+	hash string
+	boc  []byte
+}
+
+func loadBocCorpus(t *testing.T, path string) []corpusBoc {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	res := make([]corpusBoc, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<24)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			t.Fatalf("invalid corpus line %q", line)
+		}
+		data, err := hex.DecodeString(fields[2])
+		if err != nil {
+			t.Fatalf("%v: %v", fields[0], err)
+		}
+		res = append(res, corpusBoc{name: fields[0], hash: fields[1], boc: data})
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestBocCorpusRoundTrip(t *testing.T) {
+	for _, c := range loadBocCorpus(t, "testdata/bocs.txt") {
+		t.Run(c.name, func(t *testing.T) {
+			cells, err := DeserializeBoc(c.boc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cells[0].HashString() != c.hash {
+				t.Fatalf("invalid root hash %v", cells[0].HashString())
+			}
+			data, err := ReserializeLike(cells[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			again, err := DeserializeBoc(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again[0].HashString() != c.hash {
+				t.Fatalf("root hash changed after round-trip: %v", again[0].HashString())
+			}
+		})
+	}
+}
+
+func TestBocCorpusOrderedRoundTrip(t *testing.T) {
+	for _, c := range loadBocCorpus(t, "testdata/bocs.txt") {
+		if c.name != "wallet_v3r2_code" {
+			continue
+		}
+		cells, rootIndices, err := DeserializeBocOrdered(c.boc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts, ok := cells[rootIndices[0]].BocOptions()
+		if !ok {
+			t.Fatal("root must keep the boc options")
+		}
+		data, err := SerializeBocOrdered(cells, rootIndices, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, c.boc) {
+			t.Fatalf("boc is not byte-identical:\n%x\n%x", data, c.boc)
+		}
+		return
+	}
+	t.Fatal("wallet_v3r2_code is missing from the corpus")
+}
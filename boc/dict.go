@@ -0,0 +1,309 @@
+package boc
+
+import (
+	"errors"
+	"math/big"
+	"math/bits"
+	"sort"
+)
+
+type DictItem struct {
+	Key   BitString
+	Value *Cell
+}
+
+// BigKey returns the key as an unsigned integer of the full key width.
+func (i DictItem) BigKey() *big.Int {
+	r := NewBitStringReader(&i.Key)
+	key, _ := r.ReadBigUint(i.Key.Cursor())
+	return key
+}
+
+// DictBuilder builds a TON Hashmap (a binary Patricia tree) with fixed-size keys.
+// Values are slices: bits and refs of the value cell are stored in the leaf.
+type DictBuilder struct {
+	keySize int
+	items   map[string]DictItem
+}
+
+func NewDictBuilder(keySize int) *DictBuilder {
+	return &DictBuilder{
+		keySize: keySize,
+		items:   make(map[string]DictItem),
+	}
+}
+
+func (d *DictBuilder) KeySize() int {
+	return d.keySize
+}
+
+func (d *DictBuilder) Size() int {
+	return len(d.items)
+}
+
+// Set stores the value under an unsigned key of KeySize bits, replacing any previous value.
+func (d *DictBuilder) Set(key *big.Int, value *Cell) error {
+	if key.Sign() < 0 {
+		return errors.New("dict key must be non-negative")
+	}
+	k := NewBitString(d.keySize)
+	if d.keySize > 0 {
+		err := k.WriteBigUint(key, d.keySize)
+		if err != nil {
+			return err
+		}
+	} else if key.Sign() != 0 {
+		return errors.New("bit length is too small")
+	}
+	d.items[k.ToBinaryString()] = DictItem{Key: k, Value: value}
+	return nil
+}
+
+// EndDict builds the hashmap root cell. Keys are sorted before building, so the
+// resulting tree does not depend on insertion order. Returns nil for an empty dict.
+func (d *DictBuilder) EndDict() (*Cell, error) {
+	if len(d.items) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, 0, len(d.items))
+	for k := range d.items {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	items := make([]DictItem, 0, len(keys))
+	for _, k := range keys {
+		items = append(items, d.items[k])
+	}
+
+	return buildDictEdge(items, 0, d.keySize)
+}
+
+// buildDictEdge builds hm_edge for sorted items whose keys share the first offset bits.
+func buildDictEdge(items []DictItem, offset int, keySize int) (*Cell, error) {
+	cell := NewCell()
+
+	labelLen := commonPrefixLen(items, offset, keySize)
+	err := writeDictLabel(&cell.Bits, items[0].Key, offset, labelLen, keySize-offset)
+	if err != nil {
+		return nil, err
+	}
+	offset += labelLen
+
+	if offset == keySize {
+		if len(items) != 1 {
+			return nil, errors.New("duplicate dict keys")
+		}
+		err = cell.Bits.writeBitsFrom(&items[0].Value.Bits, 0, items[0].Value.BitSize())
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range items[0].Value.Refs() {
+			_, err = cell.AddReference(ref)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return cell, nil
+	}
+
+	// items are sorted, so the left branch is a prefix of the slice
+	split := sort.Search(len(items), func(i int) bool {
+		return items[i].Key.Get(offset)
+	})
+	left, err := buildDictEdge(items[:split], offset+1, keySize)
+	if err != nil {
+		return nil, err
+	}
+	right, err := buildDictEdge(items[split:], offset+1, keySize)
+	if err != nil {
+		return nil, err
+	}
+	_, err = cell.AddReference(left)
+	if err != nil {
+		return nil, err
+	}
+	_, err = cell.AddReference(right)
+	if err != nil {
+		return nil, err
+	}
+	return cell, nil
+}
+
+func commonPrefixLen(items []DictItem, offset int, keySize int) int {
+	if len(items) == 1 {
+		return keySize - offset
+	}
+	first := items[0].Key
+	last := items[len(items)-1].Key
+	n := 0
+	for offset+n < keySize && first.Get(offset+n) == last.Get(offset+n) {
+		n++
+	}
+	return n
+}
+
+// writeDictLabel writes HmLabel choosing the shortest of hml_short, hml_long and hml_same.
+func writeDictLabel(s *BitString, key BitString, offset int, labelLen int, maxLen int) error {
+	lenBits := bits.Len(uint(maxLen))
+
+	shortLen := 2 + 2*labelLen
+	longLen := 2 + lenBits + labelLen
+	sameLen := shortLen + 1
+
+	same := labelLen > 0
+	for i := 1; i < labelLen && same; i++ {
+		same = key.Get(offset+i) == key.Get(offset)
+	}
+	if same {
+		sameLen = 3 + lenBits
+	}
+
+	if sameLen < shortLen && sameLen < longLen {
+		err := s.WriteBitArray([]bool{true, true, key.Get(offset)})
+		if err != nil {
+			return err
+		}
+		return s.WriteBoundedUint(uint64(labelLen), uint64(maxLen))
+	}
+
+	if longLen < shortLen {
+		err := s.WriteBitArray([]bool{true, false})
+		if err != nil {
+			return err
+		}
+		err = s.WriteBoundedUint(uint64(labelLen), uint64(maxLen))
+		if err != nil {
+			return err
+		}
+		return s.writeBitsFrom(&key, offset, labelLen)
+	}
+
+	err := s.WriteBit(false)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < labelLen; i++ {
+		err = s.WriteBit(true)
+		if err != nil {
+			return err
+		}
+	}
+	err = s.WriteBit(false)
+	if err != nil {
+		return err
+	}
+	return s.writeBitsFrom(&key, offset, labelLen)
+}
+
+// ParseDict reads all entries of a Hashmap with the given key size. Entries are
+// returned in ascending key order. A nil root is treated as an empty dict.
+func ParseDict(root *Cell, keySize int) ([]DictItem, error) {
+	items := make([]DictItem, 0)
+	if root == nil {
+		return items, nil
+	}
+	key := NewBitString(keySize)
+	err := parseDictEdge(root, key, keySize, &items)
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func parseDictEdge(cell *Cell, key BitString, keySize int, items *[]DictItem) error {
+	r := cell.BeginParse()
+
+	err := readDictLabel(&r, &key, keySize-key.Cursor())
+	if err != nil {
+		return err
+	}
+
+	if key.Cursor() == keySize {
+		value, err := cellFromRemainder(&r)
+		if err != nil {
+			return err
+		}
+		*items = append(*items, DictItem{Key: key.Copy(), Value: value})
+		return nil
+	}
+
+	refs := cell.Refs()
+	if len(refs) != 2 {
+		return errors.New("dict fork must have two refs")
+	}
+	for i, ref := range refs {
+		branch := key.Copy()
+		err = branch.WriteBit(i == 1)
+		if err != nil {
+			return err
+		}
+		err = parseDictEdge(ref, branch, keySize, items)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readDictLabel(r *BitStringReader, key *BitString, maxLen int) error {
+	if r.Available() < 1 {
+		return errNotEnoughBits
+	}
+	if !r.ReadBit() {
+		// hml_short$0
+		n := 0
+		for {
+			if r.Available() < 1 {
+				return errNotEnoughBits
+			}
+			if !r.ReadBit() {
+				break
+			}
+			n++
+		}
+		if n > maxLen {
+			return errors.New("dict label is too long")
+		}
+		if r.Available() < n {
+			return errNotEnoughBits
+		}
+		for i := 0; i < n; i++ {
+			key.WriteBit(r.ReadBit())
+		}
+		return nil
+	}
+
+	if r.Available() < 1 {
+		return errNotEnoughBits
+	}
+	if !r.ReadBit() {
+		// hml_long$10
+		n, err := r.ReadBoundedUint(uint64(maxLen))
+		if err != nil {
+			return err
+		}
+		if r.Available() < int(n) {
+			return errNotEnoughBits
+		}
+		for i := 0; i < int(n); i++ {
+			key.WriteBit(r.ReadBit())
+		}
+		return nil
+	}
+
+	// hml_same$11
+	if r.Available() < 1 {
+		return errNotEnoughBits
+	}
+	v := r.ReadBit()
+	n, err := r.ReadBoundedUint(uint64(maxLen))
+	if err != nil {
+		return err
+	}
+	for i := 0; i < int(n); i++ {
+		key.WriteBit(v)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package boc
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+)
+
+func TestDictBuilderDeterministic(t *testing.T) {
+	keys := []int64{7, 0, 255, 128, 3, 64}
+
+	build := func(order []int64) (*Cell, []byte) {
+		d := NewDictBuilder(8)
+		for _, k := range order {
+			v := NewCell()
+			v.Bits.WriteUint(int(k)*3+1, 16)
+			err := d.Set(big.NewInt(k), v)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		root, err := d.EndDict()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := root.ToBoc()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return root, b
+	}
+
+	reversed := make([]int64, len(keys))
+	for i, k := range keys {
+		reversed[len(keys)-1-i] = k
+	}
+
+	root1, boc1 := build(keys)
+	root2, boc2 := build(reversed)
+
+	if !bytes.Equal(root1.Hash(), root2.Hash()) {
+		t.Fatal("dict hash depends on insertion order")
+	}
+	if !bytes.Equal(boc1, boc2) {
+		t.Fatal("dict boc depends on insertion order")
+	}
+}
+
+func TestDictBuilderEmpty(t *testing.T) {
+	root, err := NewDictBuilder(32).EndDict()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root != nil {
+		t.Fatal("empty dict must have no root")
+	}
+}
+
+func TestDictBuilderSingleLabel(t *testing.T) {
+	d := NewDictBuilder(8)
+	v := NewCell()
+	v.Bits.WriteUint(5, 3)
+	d.Set(big.NewInt(0xff), v)
+	root, err := d.EndDict()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// hml_same$11 v:1 n:(#<= 8)=8 followed by the 3-bit value
+	if root.Bits.ToBinaryString() != "111"+"1000"+"101" {
+		t.Fatalf("unexpected leaf: %s", root.Bits.ToBinaryString())
+	}
+}
+
+func TestParseDict(t *testing.T) {
+	d := NewDictBuilder(16)
+	for _, k := range []int64{0xffff, 1, 0x8000, 0x7fff, 2} {
+		v := NewCell()
+		v.Bits.WriteUint(int(k), 16)
+		d.Set(big.NewInt(k), v)
+	}
+	root, err := d.EndDict()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := ParseDict(root, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []uint{1, 2, 0x7fff, 0x8000, 0xffff}
+	if len(items) != len(expected) {
+		t.Fatalf("expected %v items, got %v", len(expected), len(items))
+	}
+	for i, item := range items {
+		kr := NewBitStringReader(&item.Key)
+		vr := item.Value.BeginParse()
+		if mustReadUint(t, &kr, 16) != expected[i] || mustReadUint(t, &vr, 16) != expected[i] {
+			t.Fatalf("invalid item %v", i)
+		}
+	}
+}
+
+func TestDict256BitKeys(t *testing.T) {
+	max := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+	keys := []*big.Int{
+		max,
+		new(big.Int).Sub(max, big.NewInt(1)),
+		new(big.Int).Lsh(big.NewInt(1), 255),
+		big.NewInt(0),
+	}
+
+	d := NewDictBuilder(256)
+	for i, k := range keys {
+		v := NewCell()
+		v.Bits.WriteUint(i, 8)
+		err := d.Set(k, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := d.Set(new(big.Int).Add(max, big.NewInt(1)), NewCell())
+	if err == nil {
+		t.Fatal("expected error for key wider than 256 bits")
+	}
+
+	root, err := d.EndDict()
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := ParseDict(root, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != len(keys) {
+		t.Fatalf("expected %v items, got %v", len(keys), len(items))
+	}
+
+	// items come in ascending key order
+	expected := []int{3, 2, 1, 0}
+	for i, item := range items {
+		k := expected[i]
+		if item.BigKey().Cmp(keys[k]) != 0 {
+			t.Fatalf("key %v is truncated: %x", k, item.BigKey())
+		}
+		r := item.Value.BeginParse()
+		if int(mustReadUint(t, &r, 8)) != k {
+			t.Fatalf("invalid value for key %v", k)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package boc
+
+import (
+	"crypto/subtle"
+	"errors"
+)
+
+type CellType int
+
+const (
+	UnknownCell      CellType = -1
+	OrdinaryCell     CellType = 0
+	PrunedBranchCell CellType = 1
+	LibraryCell      CellType = 2
+	MerkleProofCell  CellType = 3
+	MerkleUpdateCell CellType = 4
+)
+
+// Type returns the cell type. For exotic cells it is taken from the first data byte.
+func (c *Cell) Type() CellType {
+	if !c.IsExotic() {
+		return OrdinaryCell
+	}
+	if c.BitSize() < 8 {
+		return UnknownCell
+	}
+	t := CellType(c.Bits.buf[0])
+	if t < PrunedBranchCell || t > MerkleUpdateCell {
+		return UnknownCell
+	}
+	return t
+}
+
+// IsPruned reports whether the cell is a pruned branch. Only the first data byte is checked.
+func (c *Cell) IsPruned() bool {
+	return c.isExotic && c.BitSize() >= 8 && CellType(c.Bits.buf[0]) == PrunedBranchCell
+}
+
+// LevelMask returns the level mask of the cell. A pruned branch stores it in its
+// second data byte, merkle cells shift the mask of their refs down by one level,
+// and ordinary cells combine the masks of their refs.
+func (c *Cell) LevelMask() int {
+	return computeCellHashes(c, map[*Cell]*cellHashes{}).levelMask
+}
+
+// NewPrunedBranch creates a pruned branch cell replacing a level 0 cell with the
+// given representation hash and depth inside a merkle structure of the given level (1-3).
+func NewPrunedBranch(hash []byte, depth uint16, level uint8) (*Cell, error) {
+	if len(hash) != 32 {
+		return nil, errors.New("hash must be 32 bytes")
+	}
+	if level < 1 || level > 3 {
+		return nil, errors.New("invalid pruned branch level")
+	}
+	c := NewCellExotic()
+	err := c.Bits.WriteUint(int(PrunedBranchCell), 8)
+	if err != nil {
+		return nil, err
+	}
+	err = c.Bits.WriteUint(1<<(level-1), 8)
+	if err != nil {
+		return nil, err
+	}
+	err = c.Bits.WriteBytes(hash)
+	if err != nil {
+		return nil, err
+	}
+	err = c.Bits.WriteUint(int(depth), 16)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewLibraryCell creates a library reference cell pointing to the library cell with the given hash.
+func NewLibraryCell(hash []byte) (*Cell, error) {
+	if len(hash) != 32 {
+		return nil, errors.New("hash must be 32 bytes")
+	}
+	c := NewCellExotic()
+	err := c.Bits.WriteUint(int(LibraryCell), 8)
+	if err != nil {
+		return nil, err
+	}
+	err = c.Bits.WriteBytes(hash)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// HashEqual compares two hashes in constant time: the time depends only on the
+// lengths of a and b, not on their contents. Hashes of different length are not equal.
+func HashEqual(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
+
+// NewMerkleProof creates a merkle proof cell for the given virtual root. The proof
+// stores the level 0 hash and depth of the root, i.e. of the tree without pruning.
+func NewMerkleProof(root *Cell) (*Cell, error) {
+	depth, err := root.LevelDepth(0)
+	if err != nil {
+		return nil, err
+	}
+	c := NewCellExotic()
+	err = c.Bits.WriteUint(int(MerkleProofCell), 8)
+	if err != nil {
+		return nil, err
+	}
+	err = c.Bits.WriteBytes(root.LevelHash(0))
+	if err != nil {
+		return nil, err
+	}
+	err = c.Bits.WriteUint(int(depth), 16)
+	if err != nil {
+		return nil, err
+	}
+	_, err = c.AddReference(root)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewMerkleUpdate creates a merkle update cell from the old and the new state. Like
+// NewMerkleProof, it stores level 0 hashes and depths of both roots.
+func NewMerkleUpdate(oldRoot *Cell, newRoot *Cell) (*Cell, error) {
+	oldDepth, err := oldRoot.LevelDepth(0)
+	if err != nil {
+		return nil, err
+	}
+	newDepth, err := newRoot.LevelDepth(0)
+	if err != nil {
+		return nil, err
+	}
+	c := NewCellExotic()
+	err = c.Bits.WriteUint(int(MerkleUpdateCell), 8)
+	if err != nil {
+		return nil, err
+	}
+	err = c.Bits.WriteBytes(oldRoot.LevelHash(0))
+	if err != nil {
+		return nil, err
+	}
+	err = c.Bits.WriteBytes(newRoot.LevelHash(0))
+	if err != nil {
+		return nil, err
+	}
+	err = c.Bits.WriteUint(int(oldDepth), 16)
+	if err != nil {
+		return nil, err
+	}
+	err = c.Bits.WriteUint(int(newDepth), 16)
+	if err != nil {
+		return nil, err
+	}
+	_, err = c.AddReference(oldRoot)
+	if err != nil {
+		return nil, err
+	}
+	_, err = c.AddReference(newRoot)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
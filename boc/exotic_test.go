@@ -0,0 +1,288 @@
+package boc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestExoticCellTypes(t *testing.T) {
+	hash := bytes.Repeat([]byte{0x5a}, 32)
+
+	data := NewCell()
+	data.Bits.WriteUint(1, 32)
+	newData := NewCell()
+	newData.Bits.WriteUint(2, 32)
+
+	pruned, err := NewPrunedBranch(hash, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	library, err := NewLibraryCell(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := NewMerkleProof(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update, err := NewMerkleUpdate(data, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		cell *Cell
+		typ  CellType
+		bits int
+	}{
+		{data, OrdinaryCell, 32},
+		{pruned, PrunedBranchCell, 8 + 8 + 256 + 16},
+		{library, LibraryCell, 8 + 256},
+		{proof, MerkleProofCell, 8 + 256 + 16},
+		{update, MerkleUpdateCell, 8 + 2*256 + 2*16},
+	}
+
+	for _, c := range cases {
+		if c.cell.BitSize() != c.bits {
+			t.Fatalf("type %v: expected %v bits, got %v", c.typ, c.bits, c.cell.BitSize())
+		}
+		b, err := c.cell.ToBoc()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := DeserializeBoc(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed[0].Type() != c.typ {
+			t.Fatalf("expected type %v, got %v", c.typ, parsed[0].Type())
+		}
+	}
+}
+
+func TestNewPrunedBranchInvalid(t *testing.T) {
+	_, err := NewPrunedBranch(make([]byte, 31), 0, 1)
+	if err == nil {
+		t.Fatal("expected error for short hash")
+	}
+	_, err = NewPrunedBranch(make([]byte, 32), 0, 4)
+	if err == nil {
+		t.Fatal("expected error for invalid level")
+	}
+}
+
+func TestExoticDescriptors(t *testing.T) {
+	pruned, err := NewPrunedBranch(bytes.Repeat([]byte{0x5a}, 32), 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := NewCell()
+	parent.Bits.WriteUint(1, 8)
+	parent.AddReference(pruned)
+	proof, err := NewMerkleProof(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		cell  *Cell
+		level int
+		d1    byte
+	}{
+		{pruned, 1, 0 + 8 + 32},
+		{parent, 1, 1 + 32},
+		{proof, 0, 1 + 8},
+	}
+	for i, c := range cases {
+		if c.cell.LevelMask() != c.level {
+			t.Fatalf("case %v: expected level mask %v, got %v", i, c.level, c.cell.LevelMask())
+		}
+		if d1 := bocReprWithoutRefs(c.cell, c.level)[0]; d1 != c.d1 {
+			t.Fatalf("case %v: expected d1 %v, got %v", i, c.d1, d1)
+		}
+	}
+
+	// the representation hash covers the same d1 as the boc, level mask included
+	prunedData, _ := pruned.DataBytes()
+	prunedHash := sha256.Sum256(append([]byte{0 + 8 + 32, 72}, prunedData...))
+	if !bytes.Equal(pruned.Hash(), prunedHash[:]) {
+		t.Fatalf("invalid pruned branch hash %x", pruned.Hash())
+	}
+	// level 0 takes the hash and depth stored in the pruned branch, higher levels
+	// hash the previous level hash instead of the data
+	level0 := sha256.Sum256(append([]byte{1, 2, 1, 0, 3}, bytes.Repeat([]byte{0x5a}, 32)...))
+	if !bytes.Equal(parent.LevelHash(0), level0[:]) {
+		t.Fatalf("invalid parent level 0 hash %x", parent.LevelHash(0))
+	}
+	repr := append([]byte{1 + 32, 2}, level0[:]...)
+	parentHash := sha256.Sum256(append(append(repr, 0, 0), prunedHash[:]...))
+	if !bytes.Equal(parent.Hash(), parentHash[:]) {
+		t.Fatalf("invalid parent hash %x", parent.Hash())
+	}
+
+	b, err := proof.ToBoc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := DeserializeBoc(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := parsed[0].ToBoc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, again) {
+		t.Fatal("exotic boc must round-trip")
+	}
+}
+
+// The proof of a pruned tree must carry the hash and depth of the full tree it
+// stands for.
+func TestMerkleProofOfPrunedTree(t *testing.T) {
+	leaf := NewCell()
+	leaf.Bits.WriteUint(0xbeef, 16)
+	inner := NewCell()
+	inner.Bits.WriteUint(2, 8)
+	inner.AddReference(leaf)
+	kept := NewCell()
+	kept.Bits.WriteUint(3, 8)
+	full := NewCell()
+	full.Bits.WriteUint(1, 8)
+	full.AddReference(inner)
+	full.AddReference(kept)
+
+	innerDepth, err := inner.Depth16()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pruned, err := NewPrunedBranch(inner.Hash(), innerDepth, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	virtual := NewCell()
+	virtual.Bits.WriteUint(1, 8)
+	virtual.AddReference(pruned)
+	virtual.AddReference(kept)
+
+	if !bytes.Equal(virtual.LevelHash(0), full.Hash()) {
+		t.Fatal("level 0 hash must be the hash of the full tree")
+	}
+	if bytes.Equal(virtual.Hash(), full.Hash()) {
+		t.Fatal("representation hash must differ from the full tree hash")
+	}
+	if d, _ := virtual.LevelDepth(0); d != 2 {
+		t.Fatalf("expected level 0 depth 2, got %v", d)
+	}
+	if d, _ := virtual.Depth16(); d != 1 {
+		t.Fatalf("expected representation depth 1, got %v", d)
+	}
+
+	proof, err := NewMerkleProof(virtual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proof.LevelMask() != 0 {
+		t.Fatalf("expected level 0 proof, got mask %v", proof.LevelMask())
+	}
+	data, _ := proof.DataBytes()
+	if !bytes.Equal(data[1:33], full.Hash()) || data[33] != 0 || data[34] != 2 {
+		t.Fatalf("proof must store the full tree hash and depth, got %x", data)
+	}
+
+	update, err := NewMerkleUpdate(virtual, full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = update.DataBytes()
+	if !bytes.Equal(data[1:33], full.Hash()) || !bytes.Equal(data[33:65], full.Hash()) {
+		t.Fatalf("update must store level 0 hashes, got %x", data)
+	}
+	if !bytes.Equal(data[65:69], []byte{0, 2, 0, 2}) {
+		t.Fatalf("update must store level 0 depths, got %x", data[65:69])
+	}
+}
+
+func TestIsPruned(t *testing.T) {
+	pruned, err := NewPrunedBranch(bytes.Repeat([]byte{0x5a}, 32), 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	library, err := NewLibraryCell(bytes.Repeat([]byte{0x5a}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an ordinary cell with the same data is not a pruned branch
+	ordinary := NewCell()
+	ordinary.Bits.WriteBits(&pruned.Bits)
+
+	if !pruned.IsPruned() {
+		t.Fatal("pruned branch is not detected")
+	}
+	if ordinary.IsPruned() || library.IsPruned() || NewCellExotic().IsPruned() {
+		t.Fatal("only pruned branches must be detected")
+	}
+}
+
+func TestHashEqual(t *testing.T) {
+	c := NewCell()
+	c.Bits.WriteUint(1, 8)
+	other := NewCell()
+	other.Bits.WriteUint(2, 8)
+
+	if !HashEqual(c.Hash(), c.Hash()) {
+		t.Fatal("same hashes must be equal")
+	}
+	if HashEqual(c.Hash(), other.Hash()) {
+		t.Fatal("different hashes must not be equal")
+	}
+	if HashEqual(c.Hash(), c.Hash()[:31]) {
+		t.Fatal("hashes of different length must not be equal")
+	}
+}
+
+func TestDeserializeBocWithLibraries(t *testing.T) {
+	code := NewCell()
+	code.Bits.WriteUint(0xff00, 16)
+	lib, err := NewLibraryCell(code.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := NewCell()
+	state.Bits.WriteUint(1, 8)
+	state.AddReference(lib)
+	data, err := state.ToBoc()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	libs := map[string]*Cell{code.HashString(): code}
+	resolve := func(hash []byte) (*Cell, error) {
+		c, ok := libs[hex.EncodeToString(hash)]
+		if !ok {
+			return nil, errors.New("library not found")
+		}
+		return c, nil
+	}
+	roots, err := DeserializeBocWithLibraries(data, resolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if roots[0].refs[0].HashString() != code.HashString() {
+		t.Fatal("library cell is not replaced")
+	}
+
+	libs[code.HashString()] = state
+	_, err = DeserializeBocWithLibraries(data, resolve)
+	if err == nil {
+		t.Fatal("cell with another hash must be rejected")
+	}
+	delete(libs, code.HashString())
+	_, err = DeserializeBocWithLibraries(data, resolve)
+	if err == nil {
+		t.Fatal("resolver error must be returned")
+	}
+}
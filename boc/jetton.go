@@ -0,0 +1,63 @@
+package boc
+
+import (
+	"math/big"
+)
+
+const JettonTransferOp = 0x0f8a7ea5
+
+// JettonTransfer is the body of the standard jetton transfer message (TEP-74).
+type JettonTransfer struct {
+	QueryID             uint64
+	Amount              *big.Int
+	Destination         *Address
+	ResponseDestination *Address
+	CustomPayload       *Cell
+	ForwardTonAmount    *big.Int
+	ForwardPayload      *Cell
+}
+
+// ParseJettonTransfer decodes the transfer#0f8a7ea5 message body. CustomPayload is nil
+// when absent. ForwardPayload is either the referenced cell or a cell holding the
+// rest of the body when the payload is stored inline.
+func ParseJettonTransfer(body *Cell) (*JettonTransfer, error) {
+	r := body.BeginParse()
+	err := ExpectOpcode(&r, JettonTransferOp)
+	if err != nil {
+		return nil, err
+	}
+	queryID, err := r.ReadUint(64)
+	if err != nil {
+		return nil, err
+	}
+
+	var res JettonTransfer
+	res.QueryID = uint64(queryID)
+	res.Amount, err = r.ReadBigCoins()
+	if err != nil {
+		return nil, err
+	}
+	res.Destination, err = r.ReadAddress()
+	if err != nil {
+		return nil, err
+	}
+	res.ResponseDestination, err = r.ReadAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	res.CustomPayload, err = readMaybeRef(&r)
+	if err != nil {
+		return nil, err
+	}
+	res.ForwardTonAmount, err = r.ReadBigCoins()
+	if err != nil {
+		return nil, err
+	}
+	res.ForwardPayload, err = readEitherCell(&r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
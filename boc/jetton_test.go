@@ -0,0 +1,89 @@
+package boc
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+)
+
+func TestParseJettonTransfer(t *testing.T) {
+	dest := Address{Workchain: 0, Address: bytes.Repeat([]byte{0x11}, 32)}
+	amount, _ := new(big.Int).SetString("1000000000000000000000000", 10)
+
+	payload := NewCell()
+	payload.Bits.WriteUint(0, 32)
+	payload.Bits.WriteBytes([]byte("hi"))
+
+	body := NewCell()
+	body.Bits.WriteUint(JettonTransferOp, 32)
+	body.Bits.WriteUint(42, 64)
+	body.Bits.WriteUint(len(amount.Bytes()), 4)
+	body.Bits.WriteBigUint(amount, len(amount.Bytes())*8)
+	body.Bits.WriteAddress(&dest)
+	body.Bits.WriteAddress(nil)
+	body.Bits.WriteBit(false)
+	body.Bits.WriteCoins(1)
+	body.Bits.WriteBit(true)
+	body.AddReference(payload)
+
+	res, err := ParseJettonTransfer(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.QueryID != 42 || res.Amount.Cmp(amount) != 0 {
+		t.Fatal("invalid query id or amount")
+	}
+	if res.Destination == nil || !bytes.Equal(res.Destination.Address, dest.Address) {
+		t.Fatal("invalid destination")
+	}
+	if res.ResponseDestination != nil || res.CustomPayload != nil {
+		t.Fatal("response destination and custom payload must be empty")
+	}
+	if res.ForwardTonAmount.Int64() != 1 {
+		t.Fatal("invalid forward amount")
+	}
+	if !bytes.Equal(res.ForwardPayload.Hash(), payload.Hash()) {
+		t.Fatal("invalid forward payload")
+	}
+}
+
+func TestParseJettonTransferInlinePayload(t *testing.T) {
+	custom := NewCell()
+	custom.Bits.WriteUint(7, 8)
+
+	body := NewCell()
+	body.Bits.WriteUint(JettonTransferOp, 32)
+	body.Bits.WriteUint(1, 64)
+	body.Bits.WriteCoins(100)
+	body.Bits.WriteAddress(&Address{Workchain: -1, Address: make([]byte, 32)})
+	body.Bits.WriteAddress(&Address{Workchain: 0, Address: make([]byte, 32)})
+	body.Bits.WriteBit(true)
+	body.AddReference(custom)
+	body.Bits.WriteCoins(0)
+	body.Bits.WriteBit(false)
+	body.Bits.WriteUint(0xabcd, 16)
+
+	res, err := ParseJettonTransfer(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Destination.Workchain != -1 || res.ResponseDestination == nil {
+		t.Fatal("invalid addresses")
+	}
+	if res.CustomPayload != custom {
+		t.Fatal("invalid custom payload")
+	}
+	if res.ForwardPayload.BitSize() != 16 || res.ForwardPayload.RefsSize() != 0 {
+		t.Fatal("invalid inline forward payload")
+	}
+}
+
+func TestParseJettonTransferInvalidOp(t *testing.T) {
+	body := NewCell()
+	body.Bits.WriteUint(0x7362d09c, 32)
+	body.Bits.WriteUint(0, 64)
+	_, err := ParseJettonTransfer(body)
+	if err == nil {
+		t.Fatal("expected invalid op error")
+	}
+}
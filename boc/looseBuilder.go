@@ -0,0 +1,112 @@
+package boc
+
+import (
+	"math/big"
+)
+
+// LooseBuilder accumulates any number of bits. Build splits them into a chain of
+// cells holding at most 1023 bits each, linked by their only ref.
+type LooseBuilder struct {
+	bits BitString
+}
+
+func NewLooseBuilder() *LooseBuilder {
+	return &LooseBuilder{bits: NewBitString(1023)}
+}
+
+// BitSize returns the number of bits written.
+func (b *LooseBuilder) BitSize() int {
+	return b.bits.Cursor()
+}
+
+// grow makes room for n more bits.
+func (b *LooseBuilder) grow(n int) error {
+	if n <= b.bits.Available() {
+		return nil
+	}
+	size := 2 * b.bits.Length()
+	if size < b.bits.Cursor()+n {
+		size = b.bits.Cursor() + n
+	}
+	res := NewBitString(size)
+	err := res.writeBitsFrom(&b.bits, 0, b.bits.Cursor())
+	if err != nil {
+		return err
+	}
+	b.bits = res
+	return nil
+}
+
+func (b *LooseBuilder) WriteBit(val bool) error {
+	err := b.grow(1)
+	if err != nil {
+		return err
+	}
+	return b.bits.WriteBit(val)
+}
+
+func (b *LooseBuilder) WriteBitArray(val []bool) error {
+	err := b.grow(len(val))
+	if err != nil {
+		return err
+	}
+	return b.bits.WriteBitArray(val)
+}
+
+func (b *LooseBuilder) WriteUint(val int, bitLen int) error {
+	err := b.grow(bitLen)
+	if err != nil {
+		return err
+	}
+	return b.bits.WriteUint(val, bitLen)
+}
+
+func (b *LooseBuilder) WriteInt(val int, bitLen int) error {
+	err := b.grow(bitLen)
+	if err != nil {
+		return err
+	}
+	return b.bits.WriteInt(val, bitLen)
+}
+
+func (b *LooseBuilder) WriteBigUint(val *big.Int, bitLen int) error {
+	err := b.grow(bitLen)
+	if err != nil {
+		return err
+	}
+	return b.bits.WriteBigUint(val, bitLen)
+}
+
+func (b *LooseBuilder) WriteBytes(data []byte) error {
+	err := b.grow(8 * len(data))
+	if err != nil {
+		return err
+	}
+	return b.bits.WriteBytes(data)
+}
+
+// Build returns the first cell of the chain. Values may be split between cells.
+func (b *LooseBuilder) Build() (*Cell, error) {
+	total := b.bits.Cursor()
+	root := NewCell()
+	c := root
+	for offset := 0; ; offset += 1023 {
+		n := total - offset
+		if n > 1023 {
+			n = 1023
+		}
+		err := c.Bits.writeBitsFrom(&b.bits, offset, n)
+		if err != nil {
+			return nil, err
+		}
+		if offset+n == total {
+			return root, nil
+		}
+		next := NewCell()
+		_, err = c.AddReference(next)
+		if err != nil {
+			return nil, err
+		}
+		c = next
+	}
+}
@@ -0,0 +1,69 @@
+package boc
+
+import (
+	"testing"
+)
+
+func TestLooseBuilder(t *testing.T) {
+	b := NewLooseBuilder()
+	for i := 0; i < 100; i++ {
+		err := b.WriteUint(i, 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := b.WriteBit(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.BitSize() != 3201 {
+		t.Fatalf("invalid bit size %v", b.BitSize())
+	}
+
+	root, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cells := 0
+	all := NewLooseBuilder()
+	for c := root; c != nil; {
+		cells++
+		if c.BitSize() > 1023 || len(c.refs) > 1 {
+			t.Fatal("invalid chain cell")
+		}
+		r := c.BeginParse()
+		for r.Available() > 0 {
+			all.WriteBit(r.ReadBit())
+		}
+		if len(c.refs) == 0 {
+			break
+		}
+		c = c.refs[0]
+	}
+	if cells != 4 {
+		t.Fatalf("expected 4 cells, got %v", cells)
+	}
+
+	r := NewBitStringReader(&all.bits)
+	for i := 0; i < 100; i++ {
+		if mustReadUint(t, &r, 32) != uint(i) {
+			t.Fatalf("invalid value %v", i)
+		}
+	}
+	if !r.ReadBit() || r.Available() != 0 {
+		t.Fatal("invalid tail")
+	}
+
+	_, err = root.ToBoc()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	empty, err := NewLooseBuilder().Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty.BitSize() != 0 || len(empty.refs) != 0 {
+		t.Fatal("empty builder must build an empty cell")
+	}
+}
@@ -0,0 +1,98 @@
+package boc
+
+import (
+	"encoding/base64"
+	"errors"
+	"math/big"
+)
+
+// IntMsgInfo is the int_msg_info header of an internal message. ExtraCurrencies
+// is keyed by the decimal currency id.
+type IntMsgInfo struct {
+	IhrDisabled     bool
+	Bounce          bool
+	Bounced         bool
+	Src             *Address
+	Dest            *Address
+	Value           *big.Int
+	ExtraCurrencies map[string]*big.Int
+	IhrFee          *big.Int
+	FwdFee          *big.Int
+	CreatedLt       uint64
+	CreatedAt       uint32
+}
+
+// MessageHash returns the hash of an external inbound message cell. This is the
+// hash explorers and liteservers use to look up a sent message; it is the
+// representation hash of the whole message, not of its body.
+func MessageHash(extMsg *Cell) ([]byte, error) {
+	r := extMsg.BeginParse()
+	// ext_in_msg_info$10
+	tag, err := r.ReadUint(2)
+	if err != nil {
+		return nil, err
+	}
+	if tag != 2 {
+		return nil, errors.New("not an external inbound message")
+	}
+	return extMsg.Hash(), nil
+}
+
+// MessageHashBase64 is MessageHash encoded as standard base64.
+func MessageHashBase64(extMsg *Cell) (string, error) {
+	hash, err := MessageHash(extMsg)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(hash), nil
+}
+
+// ReadIntMsgInfo reads int_msg_info$0 including the tag. Src is nil for addr_none,
+// as in outgoing messages before the validator fills it. The reader must come
+// from Cell.BeginParse, since extra currencies are stored in a ref.
+func (s *BitStringReader) ReadIntMsgInfo() (*IntMsgInfo, error) {
+	if s.Available() < 4 {
+		return nil, errNotEnoughBits
+	}
+	if s.ReadBit() {
+		return nil, errors.New("not an internal message")
+	}
+
+	var res IntMsgInfo
+	res.IhrDisabled = s.ReadBit()
+	res.Bounce = s.ReadBit()
+	res.Bounced = s.ReadBit()
+
+	var err error
+	res.Src, err = s.ReadAddress()
+	if err != nil {
+		return nil, err
+	}
+	res.Dest, err = s.ReadAddress()
+	if err != nil {
+		return nil, err
+	}
+	res.Value, res.ExtraCurrencies, err = s.ReadCurrencyCollection()
+	if err != nil {
+		return nil, err
+	}
+	res.IhrFee, err = s.ReadBigCoins()
+	if err != nil {
+		return nil, err
+	}
+	res.FwdFee, err = s.ReadBigCoins()
+	if err != nil {
+		return nil, err
+	}
+	lt, err := s.ReadUint(64)
+	if err != nil {
+		return nil, err
+	}
+	res.CreatedLt = uint64(lt)
+	at, err := s.ReadUint(32)
+	if err != nil {
+		return nil, err
+	}
+	res.CreatedAt = uint32(at)
+	return &res, nil
+}
@@ -0,0 +1,130 @@
+package boc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+	"testing"
+)
+
+func TestMessageHash(t *testing.T) {
+	dest := Address{Workchain: 0, Address: bytes.Repeat([]byte{0xff}, 32)}
+	msg := NewCell()
+	msg.Bits.WriteUint(2, 2)
+	msg.Bits.WriteAddress(nil)
+	msg.Bits.WriteAddress(&dest)
+	msg.Bits.WriteCoins(0)
+	msg.Bits.WriteBit(false)
+	msg.Bits.WriteBit(false)
+	msg.Bits.WriteUint(7, 32)
+
+	hash, err := MessageHash(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The expected hash is sha256 of the representation of the 309 bit cell:
+	// d1, d2, then ext_in_msg_info$10, addr_none, addr_std, zero fee, no init,
+	// inline body and the completion tag.
+	data, _ := hex.DecodeString("8801fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffe000000003c")
+	want := sha256.Sum256(append([]byte{0x00, 77}, data...))
+	if !bytes.Equal(hash, want[:]) {
+		t.Fatalf("invalid message hash %x", hash)
+	}
+	b64, err := MessageHashBase64(msg)
+	if err != nil || b64 != "Wb4yjdQQTzg/h5OJqlYyV9hltldSCp88O0QGqoOU31s=" {
+		t.Fatalf("invalid base64 message hash %v", b64)
+	}
+
+	internal := NewCell()
+	internal.Bits.WriteBit(false)
+	internal.Bits.WriteUint(0, 8)
+	_, err = MessageHash(internal)
+	if err == nil {
+		t.Fatal("internal message must be rejected")
+	}
+}
+
+func TestReadIntMsgInfo(t *testing.T) {
+	src := Address{Workchain: -1, Address: bytes.Repeat([]byte{0x01}, 32)}
+	dest := Address{Workchain: 0, Address: bytes.Repeat([]byte{0x02}, 32)}
+
+	msg := NewCell()
+	msg.Bits.WriteBit(false)
+	msg.Bits.WriteBitArray([]bool{true, true, false})
+	msg.Bits.WriteAddress(&src)
+	msg.Bits.WriteAddress(&dest)
+	msg.Bits.WriteCoins(1500000000)
+	msg.Bits.WriteBit(false)
+	msg.Bits.WriteCoins(0)
+	msg.Bits.WriteCoins(666672)
+	msg.Bits.WriteUint(32000001000003, 64)
+	msg.Bits.WriteUint(1700000000, 32)
+	msg.Bits.WriteBitArray([]bool{false, false})
+
+	r := msg.BeginParse()
+	info, err := r.ReadIntMsgInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IhrDisabled || !info.Bounce || info.Bounced {
+		t.Fatal("invalid flags")
+	}
+	if info.Src.Workchain != -1 || !bytes.Equal(info.Src.Address, src.Address) || !bytes.Equal(info.Dest.Address, dest.Address) {
+		t.Fatal("invalid addresses")
+	}
+	if info.Value.Int64() != 1500000000 || len(info.ExtraCurrencies) != 0 {
+		t.Fatal("invalid value")
+	}
+	if info.IhrFee.Sign() != 0 || info.FwdFee.Int64() != 666672 {
+		t.Fatal("invalid fees")
+	}
+	if info.CreatedLt != 32000001000003 || info.CreatedAt != 1700000000 {
+		t.Fatal("invalid created lt or time")
+	}
+	if r.Available() != 2 {
+		t.Fatal("reader must stop after the header")
+	}
+
+	// A bounced message carrying 1000 units of extra currency 239.
+	amount := NewCell()
+	amount.Bits.WriteUint(2, 5)
+	amount.Bits.WriteUint(1000, 16)
+	d := NewDictBuilder(32)
+	d.Set(big.NewInt(239), amount)
+	extra, err := d.EndDict()
+	if err != nil {
+		t.Fatal(err)
+	}
+	withExtra := NewCell()
+	withExtra.Bits.WriteBit(false)
+	withExtra.Bits.WriteBitArray([]bool{true, false, true})
+	withExtra.Bits.WriteAddress(&dest)
+	withExtra.Bits.WriteAddress(&src)
+	withExtra.Bits.WriteCoins(1)
+	withExtra.Bits.WriteBit(true)
+	withExtra.AddReference(extra)
+	withExtra.Bits.WriteCoins(0)
+	withExtra.Bits.WriteCoins(0)
+	withExtra.Bits.WriteUint(1, 64)
+	withExtra.Bits.WriteUint(1700000001, 32)
+	r = withExtra.BeginParse()
+	info, err = r.ReadIntMsgInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Bounce || !info.Bounced || info.Src.Workchain != 0 || info.Dest.Workchain != -1 {
+		t.Fatal("invalid flags or addresses of the message with extra currencies")
+	}
+	if len(info.ExtraCurrencies) != 1 || info.ExtraCurrencies["239"].Int64() != 1000 {
+		t.Fatalf("invalid extra currencies %v", info.ExtraCurrencies)
+	}
+
+	ext := NewCell()
+	ext.Bits.WriteUint(2, 2)
+	r = ext.BeginParse()
+	_, err = r.ReadIntMsgInfo()
+	if err == nil {
+		t.Fatal("external message must be rejected")
+	}
+}
@@ -0,0 +1,93 @@
+package boc
+
+import (
+	"math/big"
+)
+
+const (
+	NftTransferOp          = 0x5fcc3d14
+	NftOwnershipAssignedOp = 0x05138d91
+)
+
+// NftTransfer is the body of the standard NFT transfer message (TEP-62).
+type NftTransfer struct {
+	QueryID             uint64
+	NewOwner            *Address
+	ResponseDestination *Address
+	CustomPayload       *Cell
+	ForwardAmount       *big.Int
+	ForwardPayload      *Cell
+}
+
+// NftOwnershipAssigned is the notification sent to the new owner of an NFT (TEP-62).
+type NftOwnershipAssigned struct {
+	QueryID        uint64
+	PrevOwner      *Address
+	ForwardPayload *Cell
+}
+
+// ParseNftTransfer decodes the transfer#5fcc3d14 message body.
+func ParseNftTransfer(body *Cell) (*NftTransfer, error) {
+	r := body.BeginParse()
+	err := ExpectOpcode(&r, NftTransferOp)
+	if err != nil {
+		return nil, err
+	}
+	queryID, err := r.ReadUint(64)
+	if err != nil {
+		return nil, err
+	}
+
+	var res NftTransfer
+	res.QueryID = uint64(queryID)
+	res.NewOwner, err = r.ReadAddress()
+	if err != nil {
+		return nil, err
+	}
+	res.ResponseDestination, err = r.ReadAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	res.CustomPayload, err = readMaybeRef(&r)
+	if err != nil {
+		return nil, err
+	}
+	res.ForwardAmount, err = r.ReadBigCoins()
+	if err != nil {
+		return nil, err
+	}
+	res.ForwardPayload, err = readEitherCell(&r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+// ParseNftOwnershipAssigned decodes the ownership_assigned#05138d91 message body.
+func ParseNftOwnershipAssigned(body *Cell) (*NftOwnershipAssigned, error) {
+	r := body.BeginParse()
+	err := ExpectOpcode(&r, NftOwnershipAssignedOp)
+	if err != nil {
+		return nil, err
+	}
+	queryID, err := r.ReadUint(64)
+	if err != nil {
+		return nil, err
+	}
+
+	var res NftOwnershipAssigned
+	res.QueryID = uint64(queryID)
+	res.PrevOwner, err = r.ReadAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	res.ForwardPayload, err = readEitherCell(&r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
@@ -0,0 +1,67 @@
+package boc
+
+import (
+	"bytes"
+	"testing"
+)
+
+// The bodies in these tests follow the TEP-62 transfer and ownership_assigned schemas.
+func TestParseNftTransfer(t *testing.T) {
+	owner := Address{Workchain: 0, Address: bytes.Repeat([]byte{0x22}, 32)}
+	response := Address{Workchain: 0, Address: bytes.Repeat([]byte{0x33}, 32)}
+
+	body := NewCell()
+	body.Bits.WriteUint(NftTransferOp, 32)
+	body.Bits.WriteUint(7, 64)
+	body.Bits.WriteAddress(&owner)
+	body.Bits.WriteAddress(&response)
+	body.Bits.WriteBit(false)
+	body.Bits.WriteCoins(10000000)
+	body.Bits.WriteBit(false)
+
+	res, err := ParseNftTransfer(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.QueryID != 7 || !bytes.Equal(res.NewOwner.Address, owner.Address) {
+		t.Fatal("invalid query id or new owner")
+	}
+	if !bytes.Equal(res.ResponseDestination.Address, response.Address) {
+		t.Fatal("invalid response destination")
+	}
+	if res.CustomPayload != nil || res.ForwardAmount.Int64() != 10000000 {
+		t.Fatal("invalid custom payload or forward amount")
+	}
+	if res.ForwardPayload.BitSize() != 0 {
+		t.Fatal("forward payload must be empty")
+	}
+}
+
+func TestParseNftOwnershipAssigned(t *testing.T) {
+	prev := Address{Workchain: 0, Address: bytes.Repeat([]byte{0x44}, 32)}
+	payload := NewCell()
+	payload.Bits.WriteUint(0, 32)
+
+	body := NewCell()
+	body.Bits.WriteUint(NftOwnershipAssignedOp, 32)
+	body.Bits.WriteUint(1, 64)
+	body.Bits.WriteAddress(&prev)
+	body.Bits.WriteBit(true)
+	body.AddReference(payload)
+
+	res, err := ParseNftOwnershipAssigned(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.QueryID != 1 || !bytes.Equal(res.PrevOwner.Address, prev.Address) {
+		t.Fatal("invalid query id or previous owner")
+	}
+	if res.ForwardPayload != payload {
+		t.Fatal("invalid forward payload")
+	}
+
+	_, err = ParseNftTransfer(body)
+	if err == nil {
+		t.Fatal("expected invalid op error")
+	}
+}
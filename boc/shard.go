@@ -0,0 +1,156 @@
+package boc
+
+import (
+	"errors"
+)
+
+// FutureSplitMerge is fsm_none, fsm_split or fsm_merge. Kind is 0 for none.
+type FutureSplitMerge struct {
+	Kind     int
+	Utime    uint32
+	Interval uint32
+}
+
+const (
+	FutureSplitMergeNone = iota
+	FutureSplitMergeSplit
+	FutureSplitMergeMerge
+)
+
+// ShardDescr holds the fixed part of shard_descr and shard_descr_new.
+// fees_collected and funds_created are not decoded.
+type ShardDescr struct {
+	SeqNo              uint32
+	RegMcSeqno         uint32
+	StartLt            uint64
+	EndLt              uint64
+	RootHash           [32]byte
+	FileHash           [32]byte
+	BeforeSplit        bool
+	BeforeMerge        bool
+	WantSplit          bool
+	WantMerge          bool
+	NxCcUpdated        bool
+	Flags              int
+	NextCatchainSeqno  uint32
+	NextValidatorShard uint64
+	MinRefMcSeqno      uint32
+	GenUtime           uint32
+	SplitMergeAt       FutureSplitMerge
+}
+
+const shardDescrFixedBits = 4 + 32 + 32 + 64 + 64 + 256 + 256 + 5 + 3 + 32 + 64 + 32 + 32 + 1
+
+// LoadShardHashes parses ShardHashes (HashmapE 32 ^(BinTree ShardDescr)) given the
+// hashmap root cell, or nil for an empty dict. Shards of every workchain are
+// returned in binary tree order.
+func LoadShardHashes(c *Cell) (map[int32][]*ShardDescr, error) {
+	items, err := ParseDict(c, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[int32][]*ShardDescr)
+	for _, item := range items {
+		keyReader := NewBitStringReader(&item.Key)
+		workchain, err := keyReader.ReadInt(32)
+		if err != nil {
+			return nil, err
+		}
+
+		refs := item.Value.Refs()
+		if len(refs) != 1 {
+			return nil, errors.New("shard hashes value must have one ref")
+		}
+		shards := make([]*ShardDescr, 0)
+		err = loadShardBinTree(refs[0], &shards)
+		if err != nil {
+			return nil, err
+		}
+		res[int32(workchain)] = shards
+	}
+	return res, nil
+}
+
+func loadShardBinTree(c *Cell, shards *[]*ShardDescr) error {
+	r := c.BeginParse()
+	if r.Available() < 1 {
+		return errNotEnoughBits
+	}
+
+	if r.ReadBit() {
+		// bt_fork$1
+		refs := c.Refs()
+		if len(refs) != 2 {
+			return errors.New("bin tree fork must have two refs")
+		}
+		for _, ref := range refs {
+			err := loadShardBinTree(ref, shards)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// bt_leaf$0
+	descr, err := readShardDescr(&r)
+	if err != nil {
+		return err
+	}
+	*shards = append(*shards, descr)
+	return nil
+}
+
+func readShardDescr(r *BitStringReader) (*ShardDescr, error) {
+	if r.Available() < shardDescrFixedBits {
+		return nil, errNotEnoughBits
+	}
+
+	// the fixed part is checked above, so these reads can't fail
+	u := func(bitLen int) uint {
+		v, _ := r.ReadUint(bitLen)
+		return v
+	}
+
+	tag := u(4)
+	if tag != 0xa && tag != 0xb {
+		return nil, errors.New("invalid shard_descr tag")
+	}
+
+	var d ShardDescr
+	d.SeqNo = uint32(u(32))
+	d.RegMcSeqno = uint32(u(32))
+	d.StartLt = uint64(u(64))
+	d.EndLt = uint64(u(64))
+	d.RootHash, _ = r.ReadHash256()
+	d.FileHash, _ = r.ReadHash256()
+	d.BeforeSplit = r.ReadBit()
+	d.BeforeMerge = r.ReadBit()
+	d.WantSplit = r.ReadBit()
+	d.WantMerge = r.ReadBit()
+	d.NxCcUpdated = r.ReadBit()
+	d.Flags = int(u(3))
+	if d.Flags != 0 {
+		return nil, errors.New("shard_descr flags must be zero")
+	}
+	d.NextCatchainSeqno = uint32(u(32))
+	d.NextValidatorShard = uint64(u(64))
+	d.MinRefMcSeqno = uint32(u(32))
+	d.GenUtime = uint32(u(32))
+
+	if r.ReadBit() {
+		if r.Available() < 1+64 {
+			return nil, errNotEnoughBits
+		}
+		if r.ReadBit() {
+			d.SplitMergeAt.Kind = FutureSplitMergeMerge
+		} else {
+			d.SplitMergeAt.Kind = FutureSplitMergeSplit
+		}
+		d.SplitMergeAt.Utime = uint32(u(32))
+		d.SplitMergeAt.Interval = uint32(u(32))
+	}
+
+	return &d, nil
+}
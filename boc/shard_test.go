@@ -0,0 +1,66 @@
+package boc
+
+import (
+	"math/big"
+	"testing"
+)
+
+func newShardDescrCell(seqNo int, splitAt bool) *Cell {
+	c := NewCell()
+	c.Bits.WriteBit(false) // bt_leaf$0
+	c.Bits.WriteUint(0xb, 4)
+	c.Bits.WriteUint(seqNo, 32)
+	c.Bits.WriteUint(100, 32)
+	c.Bits.WriteUint(1000, 64)
+	c.Bits.WriteUint(2000, 64)
+	c.Bits.WriteBytes(make([]byte, 64))
+	c.Bits.WriteBitArray([]bool{false, false, true, false, false})
+	c.Bits.WriteUint(0, 3)
+	c.Bits.WriteUint(7, 32)
+	c.Bits.WriteUint(0, 64)
+	c.Bits.WriteUint(99, 32)
+	c.Bits.WriteUint(1650000000, 32)
+	if splitAt {
+		c.Bits.WriteBitArray([]bool{true, false})
+		c.Bits.WriteUint(1650000100, 32)
+		c.Bits.WriteUint(60, 32)
+	} else {
+		c.Bits.WriteBit(false)
+	}
+	return c
+}
+
+// The trees below follow the bt_leaf$0 / bt_fork$1 layout of BinTree ShardDescr.
+func TestLoadShardHashes(t *testing.T) {
+	fork := NewCell()
+	fork.Bits.WriteBit(true) // bt_fork$1
+	fork.AddReference(newShardDescrCell(10, true))
+	fork.AddReference(newShardDescrCell(11, false))
+
+	value := NewCell()
+	value.AddReference(fork)
+
+	d := NewDictBuilder(32)
+	d.Set(big.NewInt(0), value)
+	root, err := d.EndDict()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shards, err := LoadShardHashes(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shards[0]) != 2 {
+		t.Fatalf("expected 2 basechain shards, got %v", len(shards[0]))
+	}
+	if shards[0][0].SeqNo != 10 || shards[0][1].SeqNo != 11 {
+		t.Fatal("invalid shards order")
+	}
+	if !shards[0][0].WantSplit || shards[0][0].SplitMergeAt.Kind != FutureSplitMergeSplit {
+		t.Fatal("invalid split flags")
+	}
+	if shards[0][1].GenUtime != 1650000000 {
+		t.Fatal("invalid gen_utime")
+	}
+}
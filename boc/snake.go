@@ -0,0 +1,107 @@
+package boc
+
+import (
+	"errors"
+)
+
+// readSnakeBytes reads snake data: the rest of r, then the whole data of every
+// cell in the chain of first refs. Every part must hold whole bytes.
+func readSnakeBytes(c *Cell, r *BitStringReader) ([]byte, error) {
+	res := make([]byte, 0)
+	for {
+		if r.Available()%8 != 0 {
+			return nil, errors.New("snake data is not byte aligned")
+		}
+		data, err := r.ReadBytes(r.Available() / 8)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, data...)
+
+		switch len(c.refs) {
+		case 0:
+			return res, nil
+		case 1:
+			c = c.refs[0]
+			next := c.BeginParse()
+			r = &next
+		default:
+			return nil, errors.New("snake cell must have at most one ref")
+		}
+	}
+}
+
+// writeSnakeBytes fills the free whole bytes of c with data and continues in a
+// chain of new cells, each linked as the first ref of the previous one.
+func writeSnakeBytes(c *Cell, data []byte) error {
+	for {
+		n := c.Bits.Available() / 8
+		if n > len(data) {
+			n = len(data)
+		}
+		err := c.Bits.WriteBytes(data[:n])
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+		if len(data) == 0 {
+			return nil
+		}
+		next := NewCell()
+		_, err = c.AddReference(next)
+		if err != nil {
+			return err
+		}
+		c = next
+	}
+}
+
+// WriteBinary writes data after the bits already written to c: it fills the free
+// whole bytes of c and continues in a chain of new cells. The first of them is
+// added as the next ref of c, so c may already have other refs.
+func WriteBinary(c *Cell, data []byte) error {
+	n := c.Bits.Available() / 8
+	if n >= len(data) {
+		return c.Bits.WriteBytes(data)
+	}
+	if len(c.refs) >= 4 {
+		return errors.New("no free ref for the rest of the data")
+	}
+	err := c.Bits.WriteBytes(data[:n])
+	if err != nil {
+		return err
+	}
+	next := NewCell()
+	err = writeSnakeBytes(next, data[n:])
+	if err != nil {
+		return err
+	}
+	_, err = c.AddReference(next)
+	return err
+}
+
+// ReadBinary reads data written by WriteBinary: the rest of r and, if the cell of
+// r has a ref not taken yet, the chain starting in that ref. r must come from
+// Cell.BeginParse.
+func ReadBinary(r *BitStringReader) ([]byte, error) {
+	if r.Available()%8 != 0 {
+		return nil, errors.New("binary data is not byte aligned")
+	}
+	res, err := r.ReadBytes(r.Available() / 8)
+	if err != nil {
+		return nil, err
+	}
+	if r.refCursor >= len(r.refs) {
+		return res, nil
+	}
+	next, err := r.readRef()
+	if err != nil {
+		return nil, err
+	}
+	nr := next.BeginParse()
+	rest, err := readSnakeBytes(next, &nr)
+	if err != nil {
+		return nil, err
+	}
+	return append(res, rest...), nil
+}
@@ -0,0 +1,49 @@
+package boc
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteBinary(t *testing.T) {
+	data := make([]byte, 400)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	header := NewCell()
+	header.Bits.WriteUint(0x7, 3)
+	header.Bits.WriteUint(0xabcd, 16)
+	extra := NewCell()
+	header.AddReference(extra)
+
+	err := WriteBinary(header, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.RefsSize() != 2 || header.Bits.Available() >= 8 {
+		t.Fatal("data must fill the header cell and continue in a new ref")
+	}
+
+	r := header.BeginParse()
+	if mustReadUint(t, &r, 3) != 0x7 || mustReadUint(t, &r, 16) != 0xabcd {
+		t.Fatal("invalid header")
+	}
+	if _, err := r.readRef(); err != nil {
+		t.Fatal(err)
+	}
+	res, err := ReadBinary(&r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, data) {
+		t.Fatal("round-trip failed")
+	}
+
+	small := NewCell()
+	small.Bits.WriteUint(1, 8)
+	err = WriteBinary(small, []byte{1, 2, 3})
+	if err != nil || small.HasRefs() {
+		t.Fatal("data that fits must stay in the cell")
+	}
+}
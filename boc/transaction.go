@@ -0,0 +1,128 @@
+package boc
+
+import (
+	"errors"
+	"math/big"
+)
+
+// AccountStatus is acc_state_uninit, acc_state_frozen, acc_state_active or
+// acc_state_nonexist, in the order of their tags.
+type AccountStatus int
+
+const (
+	AccountUninit AccountStatus = iota
+	AccountFrozen
+	AccountActive
+	AccountNonexist
+)
+
+// Transaction holds the top level fields of a transaction. Messages, the state
+// update and the description are returned as raw cells. OutMsgs is in ascending
+// key order.
+type Transaction struct {
+	AccountAddr    [32]byte
+	Lt             uint64
+	PrevTransHash  [32]byte
+	PrevTransLt    uint64
+	Now            uint32
+	OutMsgCnt      uint16
+	OrigStatus     AccountStatus
+	EndStatus      AccountStatus
+	InMsg          *Cell
+	OutMsgs        []*Cell
+	TotalFees      *big.Int
+	TotalFeesExtra map[string]*big.Int
+	StateUpdate    *Cell
+	Description    *Cell
+}
+
+// ParseTransaction decodes transaction$0111.
+func ParseTransaction(c *Cell) (*Transaction, error) {
+	r := c.BeginParse()
+	if r.Available() < 4+256+64+256+64+32+15+2+2 {
+		return nil, errNotEnoughBits
+	}
+
+	// the fixed part is checked above, so these reads can't fail
+	u := func(bitLen int) uint {
+		v, _ := r.ReadUint(bitLen)
+		return v
+	}
+
+	if u(4) != 0x7 {
+		return nil, errors.New("invalid transaction tag")
+	}
+	var res Transaction
+	res.AccountAddr, _ = r.ReadHash256()
+	res.Lt = uint64(u(64))
+	res.PrevTransHash, _ = r.ReadHash256()
+	res.PrevTransLt = uint64(u(64))
+	res.Now = uint32(u(32))
+	res.OutMsgCnt = uint16(u(15))
+	res.OrigStatus = AccountStatus(u(2))
+	res.EndStatus = AccountStatus(u(2))
+
+	msgs, err := r.readRef()
+	if err != nil {
+		return nil, err
+	}
+	err = readTransactionMessages(msgs, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	res.TotalFees, res.TotalFeesExtra, err = r.ReadCurrencyCollection()
+	if err != nil {
+		return nil, err
+	}
+	res.StateUpdate, err = r.readRef()
+	if err != nil {
+		return nil, err
+	}
+	res.Description, err = r.readRef()
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// readTransactionMessages reads in_msg:(Maybe ^(Message Any)) and
+// out_msgs:(HashmapE 15 ^(Message Any)).
+func readTransactionMessages(c *Cell, res *Transaction) error {
+	r := c.BeginParse()
+	hasIn, err := r.ReadBool()
+	if err != nil {
+		return err
+	}
+	if hasIn {
+		res.InMsg, err = r.readRef()
+		if err != nil {
+			return err
+		}
+	}
+
+	hasOut, err := r.ReadBool()
+	if err != nil {
+		return err
+	}
+	res.OutMsgs = make([]*Cell, 0)
+	if !hasOut {
+		return nil
+	}
+	root, err := r.readRef()
+	if err != nil {
+		return err
+	}
+	items, err := ParseDict(root, 15)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		refs := item.Value.Refs()
+		if len(refs) != 1 {
+			return errors.New("out message value must have one ref")
+		}
+		res.OutMsgs = append(res.OutMsgs, refs[0])
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package boc
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+)
+
+func TestParseTransaction(t *testing.T) {
+	inMsg := NewCell()
+	inMsg.Bits.WriteUint(1, 8)
+	outMsgs := make([]*Cell, 2)
+	dict := NewDictBuilder(15)
+	for i := range outMsgs {
+		outMsgs[i] = NewCell()
+		outMsgs[i].Bits.WriteUint(10+i, 8)
+		value := NewCell()
+		value.AddReference(outMsgs[i])
+		err := dict.Set(big.NewInt(int64(i)), value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	outRoot, err := dict.EndDict()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := NewCell()
+	msgs.Bits.WriteBool(true)
+	msgs.AddReference(inMsg)
+	msgs.Bits.WriteBool(true)
+	msgs.AddReference(outRoot)
+
+	stateUpdate := NewCell()
+	stateUpdate.Bits.WriteUint(0x72, 8)
+	descr := NewCell()
+	descr.Bits.WriteUint(0, 4)
+
+	tx := NewCell()
+	tx.Bits.WriteUint(0x7, 4)
+	tx.Bits.WriteBytes(bytes.Repeat([]byte{0xaa}, 32))
+	tx.Bits.WriteUint(47000000000003, 64)
+	tx.Bits.WriteBytes(bytes.Repeat([]byte{0xbb}, 32))
+	tx.Bits.WriteUint(47000000000001, 64)
+	tx.Bits.WriteUint(1700000000, 32)
+	tx.Bits.WriteUint(2, 15)
+	tx.Bits.WriteUint(int(AccountUninit), 2)
+	tx.Bits.WriteUint(int(AccountActive), 2)
+	tx.AddReference(msgs)
+	tx.Bits.WriteCoins(4200000)
+	tx.Bits.WriteBit(false)
+	tx.AddReference(stateUpdate)
+	tx.AddReference(descr)
+
+	res, err := ParseTransaction(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.AccountAddr[0] != 0xaa || res.PrevTransHash[31] != 0xbb {
+		t.Fatal("invalid hashes")
+	}
+	if res.Lt != 47000000000003 || res.PrevTransLt != 47000000000001 || res.Now != 1700000000 {
+		t.Fatal("invalid lt or time")
+	}
+	if res.OutMsgCnt != 2 || res.OrigStatus != AccountUninit || res.EndStatus != AccountActive {
+		t.Fatal("invalid counters or statuses")
+	}
+	if res.InMsg != inMsg || len(res.OutMsgs) != 2 || res.OutMsgs[0] != outMsgs[0] || res.OutMsgs[1] != outMsgs[1] {
+		t.Fatal("invalid messages")
+	}
+	if res.TotalFees.Int64() != 4200000 || len(res.TotalFeesExtra) != 0 {
+		t.Fatal("invalid fees")
+	}
+	if res.StateUpdate != stateUpdate || res.Description != descr {
+		t.Fatal("invalid refs")
+	}
+
+	broken := NewCell()
+	broken.Bits.WriteUint(0x6, 4)
+	_, err = ParseTransaction(broken)
+	if err == nil {
+		t.Fatal("short cell must fail")
+	}
+}
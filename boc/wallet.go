@@ -0,0 +1,78 @@
+package boc
+
+import (
+	"errors"
+)
+
+// WalletV3Data is the persistent data of wallet v3 contracts.
+type WalletV3Data struct {
+	Seqno       uint32
+	SubwalletID uint32
+	PublicKey   [32]byte
+}
+
+// WalletV4Data is the persistent data of wallet v4 contracts. Plugins holds the
+// addresses of installed plugins in ascending key order.
+type WalletV4Data struct {
+	Seqno       uint32
+	SubwalletID uint32
+	PublicKey   [32]byte
+	Plugins     []Address
+}
+
+// ParseWalletV3Data decodes seqno:uint32 subwallet:uint32 public_key:bits256.
+func ParseWalletV3Data(data *Cell) (*WalletV3Data, error) {
+	r := data.BeginParse()
+	var res WalletV3Data
+	err := readWalletHeader(&r, &res.Seqno, &res.SubwalletID, &res.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// ParseWalletV4Data decodes the v3 fields followed by plugins:(HashmapE 264 Unit),
+// keyed by plugin workchain (int8) and address.
+func ParseWalletV4Data(data *Cell) (*WalletV4Data, error) {
+	r := data.BeginParse()
+	var res WalletV4Data
+	err := readWalletHeader(&r, &res.Seqno, &res.SubwalletID, &res.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	plugins, err := readMaybeRef(&r)
+	if err != nil {
+		return nil, err
+	}
+	items, err := ParseDict(plugins, 8+256)
+	if err != nil {
+		return nil, err
+	}
+	res.Plugins = make([]Address, 0, len(items))
+	for _, item := range items {
+		kr := NewBitStringReader(&item.Key)
+		workchain, err := kr.ReadInt(8)
+		if err != nil {
+			return nil, err
+		}
+		addr, err := kr.ReadHash256()
+		if err != nil {
+			return nil, err
+		}
+		res.Plugins = append(res.Plugins, Address{Workchain: int32(workchain), Address: addr[:]})
+	}
+	return &res, nil
+}
+
+func readWalletHeader(r *BitStringReader, seqno *uint32, subwalletID *uint32, publicKey *[32]byte) error {
+	if r.Available() < 32+32+256 {
+		return errors.New("not enough bits for wallet data")
+	}
+	v, _ := r.ReadUint(32)
+	*seqno = uint32(v)
+	v, _ = r.ReadUint(32)
+	*subwalletID = uint32(v)
+	*publicKey, _ = r.ReadHash256()
+	return nil
+}
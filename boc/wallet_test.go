@@ -0,0 +1,77 @@
+package boc
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+)
+
+func walletDataCell(seqno int, publicKey []byte) *Cell {
+	c := NewCell()
+	c.Bits.WriteUint(seqno, 32)
+	c.Bits.WriteUint(698983191, 32)
+	c.Bits.WriteBytes(publicKey)
+	return c
+}
+
+func TestParseWalletV3Data(t *testing.T) {
+	key := bytes.Repeat([]byte{0x5e}, 32)
+	res, err := ParseWalletV3Data(walletDataCell(12, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Seqno != 12 || res.SubwalletID != 698983191 || !bytes.Equal(res.PublicKey[:], key) {
+		t.Fatalf("invalid wallet data %+v", res)
+	}
+
+	short := NewCell()
+	short.Bits.WriteUint(1, 32)
+	_, err = ParseWalletV3Data(short)
+	if err == nil {
+		t.Fatal("expected not enough bits")
+	}
+}
+
+func TestParseWalletV4Data(t *testing.T) {
+	key := bytes.Repeat([]byte{0x5e}, 32)
+	plugins := []Address{
+		{Workchain: 0, Address: bytes.Repeat([]byte{0x01}, 32)},
+		{Workchain: -1, Address: bytes.Repeat([]byte{0x02}, 32)},
+	}
+	d := NewDictBuilder(8 + 256)
+	for _, p := range plugins {
+		k := new(big.Int).Lsh(big.NewInt(int64(uint8(p.Workchain))), 256)
+		k.Or(k, new(big.Int).SetBytes(p.Address))
+		d.Set(k, NewCell())
+	}
+	dict, err := d.EndDict()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := walletDataCell(3, key)
+	c.Bits.WriteBit(true)
+	c.AddReference(dict)
+	res, err := ParseWalletV4Data(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Seqno != 3 || !bytes.Equal(res.PublicKey[:], key) || len(res.Plugins) != 2 {
+		t.Fatalf("invalid wallet data %+v", res)
+	}
+	for i, p := range plugins {
+		if res.Plugins[i].Workchain != p.Workchain || !bytes.Equal(res.Plugins[i].Address, p.Address) {
+			t.Fatalf("invalid plugin %v: %+v", i, res.Plugins[i])
+		}
+	}
+
+	empty := walletDataCell(0, key)
+	empty.Bits.WriteBit(false)
+	res, err = ParseWalletV4Data(empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Plugins) != 0 {
+		t.Fatal("expected no plugins")
+	}
+}